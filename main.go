@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -34,15 +35,22 @@ const (
 )
 
 var (
-	orchestrator   *Orchestrator
-	api            *TargetExporter
-	kubeclient     *Kubeclient
-	promclient     *Promclient
-	pyzhmClient    *pyzhm.PyzhmClient
-	metricsSrv     *http.Server
-	bootCfg        Config
-	logger         *zap.Logger
-	serverSwitches map[string]*serverswitch.IpmiServerSwitch
+	orchestrator *Orchestrator
+	api          *TargetExporter
+	kubeclient   *Kubeclient
+	promclient   *Promclient
+	pyzhmClient  *pyzhm.PyzhmClient
+	placer       pyzhm.Placer
+	jobTemplates *JobTemplateRegistry
+	decisionLog  *DecisionLog
+	metricsSrv   *http.Server
+	bootCfg      Config
+	logger       *zap.Logger
+	bmcPool      *serverswitch.Pool
+	bmcMonitor   *serverswitch.Monitor
+	nodeMappings *pyzhm.NodeMappings
+	// initialStrategies are the strategies enabled or disabled on startup by the config
+	initialStrategies map[string]StrategyState
 
 	// Flags
 	config            = "config.yaml"
@@ -135,16 +143,66 @@ func initPromClient() {
 	promclient = NewPromClient(promv1, logger)
 }
 
+// initServerOnOff registers the BMC of each server in the bootconfig, connections are established in the background
+// once the pool is started, so that unreachable BMCs neither block the boot nor get dropped.
 func initServerOnOff() {
-	serverSwitches = make(map[string]*serverswitch.IpmiServerSwitch)
-	// For each server in the bootconfig, create a server switch
+	bmcPool = serverswitch.NewPool(logger)
 	for k, v := range bootCfg.BmcNodeMappings {
-		sswitch, err := serverswitch.NewIpmiServerSwitch(v, bootCfg.BmcUsername, bootCfg.BmcPassword, logger)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Error creating server switch: %s", err.Error()))
-			continue
+		nodeName, endpoint := k, v
+		bmcPool.Add(nodeName, endpoint, func() (serverswitch.ServerSwitch, error) {
+			return newServerSwitch(nodeName, endpoint)
+		})
+	}
+}
+
+// newServerSwitch creates the server switch of a node using the BMC protocol configured for it.
+func newServerSwitch(nodeName, endpoint string) (serverswitch.ServerSwitch, error) {
+	protocol := bootCfg.BmcProtocol
+	if nodeProtocol, ok := bootCfg.BmcProtocols[nodeName]; ok {
+		protocol = nodeProtocol
+	}
+	switch protocol {
+	case "", serverswitch.ProtocolIpmi:
+		return serverswitch.NewIpmiServerSwitch(endpoint, bootCfg.BmcUsername, bootCfg.BmcPassword, logger)
+	case serverswitch.ProtocolRedfish:
+		return serverswitch.NewRedfishServerSwitch(endpoint, bootCfg.BmcUsername, bootCfg.BmcPassword,
+			bootCfg.BmcInsecureSkipVerify, logger)
+	case serverswitch.ProtocolSimulated:
+		options := make([]serverswitch.SimulatedServerSwitchOption, 0)
+		if bootCfg.Simulation.BootDelay > 0 {
+			options = append(options, serverswitch.BootDelay(bootCfg.Simulation.BootDelay))
+		}
+		if bootCfg.Simulation.ShutdownDelay > 0 {
+			options = append(options, serverswitch.ShutdownDelay(bootCfg.Simulation.ShutdownDelay))
+		}
+		if bootCfg.Simulation.TaintNodes {
+			options = append(options, serverswitch.TaintNode(kubeclient))
+		}
+		return serverswitch.NewSimulatedServerSwitch(nodeName, endpoint, logger, options...), nil
+	default:
+		return nil, fmt.Errorf("unknown BMC protocol %s for node %s", protocol, nodeName)
+	}
+}
+
+func initJobTemplates() {
+	jobTemplates = NewJobTemplateRegistry(logger)
+	if dir := bootCfg.JobTemplates.Dir; dir != "" {
+		if err := jobTemplates.LoadDir(dir); err != nil {
+			logger.Fatal(fmt.Sprintf("Error loading job templates from %s: %s", dir, err.Error()))
+		}
+	}
+	for _, configMap := range bootCfg.JobTemplates.ConfigMaps {
+		if err := jobTemplates.LoadConfigMap(kubeclient, configMap); err != nil {
+			logger.Fatal(fmt.Sprintf("Error loading job templates from ConfigMap %s: %s", configMap, err.Error()))
 		}
-		serverSwitches[k] = sswitch
+	}
+}
+
+func initDecisionLog() {
+	var err error
+	decisionLog, err = NewDecisionLog(bootCfg.PlacementLog.Size, bootCfg.PlacementLog.File, logger)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error opening placement log file: %s", err.Error()))
 	}
 }
 
@@ -156,21 +214,123 @@ func initMetricsServer() {
 }
 
 func initOrchestrator() {
-	strategy := NewServerOnOffStrategy(serverSwitches, promclient, logger)
-	// TODO: Add switch to turn on/off to the dashboard
-	strategy.Start()
+	options := make([]ServerOnOffOption, 0)
+	if bootCfg.ServerOnOff.BootTimeout > 0 {
+		options = append(options, BootTimeout(bootCfg.ServerOnOff.BootTimeout))
+	}
+	if bootCfg.ServerOnOff.MinOnTime > 0 {
+		options = append(options, MinOnTime(bootCfg.ServerOnOff.MinOnTime))
+	}
+	if bootCfg.ServerOnOff.Efficiency != nil {
+		options = append(options, Efficiency(bootCfg.ServerOnOff.Efficiency))
+	}
+	// Disabled by default, it can be started with PUT /api/v1/server-on-off
+	strategy := NewServerOnOffStrategy(bmcPool, kubeclient, promclient, api.Targets(), api.Schedulable(), logger,
+		options...)
+
+	thermalCfg := bootCfg.Thermal
+	thermal := NewThermalStrategy(promclient, bmcMonitor, nodeMappings, api.Targets(), bootCfg.Setpoints,
+		ThermalThresholds{
+			InletHigh:     thermalCfg.InletHigh,
+			InletCritical: thermalCfg.InletCritical,
+			CpuHigh:       thermalCfg.CpuHigh,
+			CpuCritical:   thermalCfg.CpuCritical,
+			Hysteresis:    thermalCfg.Hysteresis,
+			SideOffsets:   thermalCfg.SideOffsets,
+			InletQuery:    thermalCfg.InletQuery,
+			CpuQuery:      thermalCfg.CpuQuery,
+			NodeLabel:     thermalCfg.NodeLabel,
+		}, logger)
 
 	orchestrator = NewOrchestrator(
 		kubeclient,
 		promclient,
-		pyzhmClient,
+		placer,
+		jobTemplates,
+		decisionLog,
 		logger,
 		api.Targets(),
 		api.Schedulable(),
 		strategy,
-		bootCfg.PyzhmNodeMappings,
+		thermal,
+		nodeMappings,
 		bootCfg.Setpoints,
+		NewArbiter(bootCfg.Arbitration.MutationWindow, logger),
+		ConflictPolicy(bootCfg.Arbitration.ConflictPolicy),
 	)
+	if err := orchestrator.RegisterStrategy(NewAutomaticJobSpawn(orchestrator, kubeclient, promclient, logger)); err != nil {
+		logger.Fatal("error registering strategy", zap.Error(err))
+	}
+	initialStrategies = make(map[string]StrategyState)
+	for name, strategyCfg := range bootCfg.Strategies {
+		if strategyCfg.Interval > 0 {
+			if err := orchestrator.SetStrategyInterval(name, strategyCfg.Interval, strategyCfg.Jitter); err != nil {
+				logger.Fatal("invalid strategy config", zap.Error(err))
+			}
+		}
+		if len(strategyCfg.Parameters) > 0 {
+			parameters, err := json.Marshal(strategyCfg.Parameters)
+			if err == nil {
+				err = orchestrator.Strategies().SetParameters(name, parameters)
+			}
+			if err != nil {
+				logger.Fatal("invalid strategy parameters", zap.String("strategy", name), zap.Error(err))
+			}
+		}
+		if strategyCfg.Enabled != nil {
+			initialStrategies[name] = StrategyState{Enabled: *strategyCfg.Enabled}
+		}
+	}
+	switch {
+	case bootCfg.State.ConfigMap != "":
+		orchestrator.Strategies().SetStore(NewConfigMapStateStore(kubeclient, bootCfg.State.ConfigMap, StateKey))
+	case bootCfg.State.File != "":
+		orchestrator.Strategies().SetStore(NewFileStateStore(bootCfg.State.File))
+	}
+}
+
+// startStrategies starts the default strategies, then applies the config and the state saved before the last
+// restart, if persistence is configured. The strategies stop when ctx is done.
+func startStrategies(ctx context.Context) {
+	orchestrator.Start(ctx)
+	orchestrator.Strategies().Apply(initialStrategies)
+	restored, err := orchestrator.Strategies().Restore()
+	if err != nil {
+		logger.Error("error restoring strategies state", zap.Error(err))
+		return
+	}
+	if restored {
+		logger.Info("strategies state restored")
+	}
+}
+
+// runLeaderElection runs the strategies only while this replica is the leader. Followers serve read requests only
+// and export the gauges of the leader.
+func runLeaderElection(ctx context.Context) {
+	identity, err := os.Hostname()
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error getting hostname for leader election: %s", err))
+	}
+	leaseName := bootCfg.LeaderElection.LeaseName
+	if leaseName == "" {
+		leaseName = "target-exporter"
+	}
+	api.SetLeader(false)
+	api.SyncGauges(ctx, NewConfigMapStateStore(kubeclient, bootCfg.State.ConfigMap, GaugesKey),
+		bootCfg.LeaderElection.GaugeSyncInterval)
+	go kubeclient.RunLeaderElection(ctx, leaseName, identity,
+		func(ctx context.Context) {
+			logger.Info("became the leader, starting strategies", zap.String("identity", identity))
+			api.SetLeader(true)
+			startStrategies(ctx)
+		},
+		func() {
+			// The strategies are stopped with the leadership context, the gauges are left as they are until those of
+			// the new leader are loaded
+			logger.Info("stopped leading, stopping strategies", zap.String("identity", identity))
+			api.SetLeader(false)
+			orchestrator.StepDown()
+		})
 }
 
 // checkConfig checks if the config is valid, in particular it makes sure that the node names specified in the
@@ -186,6 +346,48 @@ func checkConfig() {
 		logger.Fatal(fmt.Sprintf("The following node names are not valid: %s. Are they reachable from target-exporter?",
 			strings.Join(invalidNames, ", ")))
 	}
+	checkPyzhmNodeMappings()
+	if bootCfg.LeaderElection.Enabled && bootCfg.State.ConfigMap == "" {
+		logger.Fatal("Leader election requires the state to be persisted in a ConfigMap (state.configMap)")
+	}
+	switch ConflictPolicy(bootCfg.Arbitration.ConflictPolicy) {
+	case "", ConflictWarn, ConflictReject:
+	default:
+		logger.Fatal(fmt.Sprintf("Unknown conflict policy: %s", bootCfg.Arbitration.ConflictPolicy))
+	}
+}
+
+// checkPyzhmNodeMappings builds the pyzhm node mappings, making sure that every mapped node exists in the cluster.
+// Mapped nodes without a BMC are reported, as they cannot be switched on or off.
+func checkPyzhmNodeMappings() {
+	var err error
+	nodeMappings, err = pyzhm.NewNodeMappings(bootCfg.PyzhmNodeMappings)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Invalid pyzhmNodeMappings: %s", err.Error()))
+	}
+	invalidNames := make([]string, 0)
+	withoutBmc := make([]string, 0)
+	for _, nodeName := range nodeMappings.NodeNames() {
+		if !kubeclient.IsNodeNameValid(nodeName) {
+			invalidNames = append(invalidNames, nodeName)
+		}
+		if _, ok := bootCfg.BmcNodeMappings[nodeName]; !ok {
+			withoutBmc = append(withoutBmc, nodeName)
+		}
+	}
+	if len(invalidNames) > 0 {
+		logger.Fatal(fmt.Sprintf("The following nodes in pyzhmNodeMappings are not valid: %s",
+			strings.Join(invalidNames, ", ")))
+	}
+	if len(withoutBmc) > 0 && len(bootCfg.BmcNodeMappings) > 0 {
+		logger.Warn(fmt.Sprintf("The following nodes in pyzhmNodeMappings have no BMC mapping: %s",
+			strings.Join(withoutBmc, ", ")))
+	}
+	for nodeName := range bootCfg.BmcNodeMappings {
+		if _, err = nodeMappings.Label(nodeName); err != nil && nodeMappings.Len() > 0 {
+			logger.Warn(fmt.Sprintf("Node with BMC mapping has no pyzhm label: %s", nodeName))
+		}
+	}
 }
 
 func init() {
@@ -195,10 +397,13 @@ func init() {
 	initKubeClient()
 
 	checkConfig()
+	initJobTemplates()
 
 	initMetricsServer()
 	initPromClient()
 	initPyzhmClient()
+	initPlacer()
+	initDecisionLog()
 
 	api = NewTargetExporter(
 		promclient,
@@ -212,20 +417,74 @@ func init() {
 }
 
 func initPyzhmClient() {
-	pyzhmClient = pyzhm.NewPyzhmClient(logger, pyzhmAddress)
+	cfg := bootCfg.Pyzhm
+	options := make([]pyzhm.PyzhmClientOption, 0)
+	if cfg.Timeout > 0 {
+		options = append(options, pyzhm.Timeout(cfg.Timeout))
+	}
+	if cfg.Retries != nil {
+		backoff := cfg.RetryBackoff
+		if backoff == 0 {
+			backoff = pyzhm.DefaultRetryBackoff
+		}
+		options = append(options, pyzhm.Retries(*cfg.Retries, backoff))
+	}
+	if cfg.FailureThreshold > 0 || cfg.OpenTimeout > 0 {
+		threshold, openTimeout := cfg.FailureThreshold, cfg.OpenTimeout
+		if threshold == 0 {
+			threshold = pyzhm.DefaultFailureThreshold
+		}
+		if openTimeout == 0 {
+			openTimeout = pyzhm.DefaultOpenTimeout
+		}
+		options = append(options, pyzhm.CircuitBreaker(threshold, openTimeout))
+	}
+	if cfg.HealthPath != "" {
+		options = append(options, pyzhm.HealthPath(cfg.HealthPath))
+	}
+	pyzhmClient = pyzhm.NewPyzhmClient(logger, pyzhmAddress, options...)
+}
+
+func initPlacer() {
+	greedyPlacer := pyzhm.NewGreedyPlacer(NewFreeCoresFunc(promclient, nodeMappings), logger)
+	switch bootCfg.Placement.Placer {
+	case pyzhm.GreedyPlacerName:
+		placer = greedyPlacer
+	case "", pyzhm.PyzhmPlacerName:
+		placer = pyzhmClient
+		if !bootCfg.Placement.DisableFallback {
+			placer = pyzhm.NewFallbackPlacer(pyzhmClient, greedyPlacer, logger)
+		}
+	default:
+		logger.Fatal(fmt.Sprintf("Unknown placer: %s", bootCfg.Placement.Placer))
+	}
 }
 
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	healthInterval := bootCfg.Pyzhm.HealthInterval
+	if healthInterval == 0 {
+		healthInterval = 10 * time.Second
+	}
+	pyzhmClient.StartHealthProbe(ctx, healthInterval)
+
 	api.StartMetrics()
 	api.StartApi()
 	initServerOnOff()
+	bmcPool.Start(ctx)
+	bmcMonitor = serverswitch.NewMonitor(bmcPool, bootCfg.BmcMonitor.Interval, logger)
+	if !bootCfg.BmcMonitor.Disabled {
+		bmcMonitor.Start(ctx)
+	}
 	initOrchestrator()
 	api.SetOrchestrator(orchestrator)
-	automaticJobSpawn := NewAutomaticJobSpawn(orchestrator, kubeclient, promclient, logger)
-	api.SetAutomaticJobSpawn(automaticJobSpawn)
+	if bootCfg.LeaderElection.Enabled {
+		runLeaderElection(ctx)
+	} else {
+		startStrategies(ctx)
+	}
 
 	// Listen for the interrupt signal from the OS
 	<-ctx.Done()
@@ -234,6 +493,9 @@ func main() {
 	stop()
 	logger.Info("Shutting down gracefully, press Ctrl+C again to force")
 
+	// Stop the strategies first, so that no cluster change is made while shutting down
+	orchestrator.Shutdown()
+
 	// The context is used to inform the server it has 30 seconds to finish
 	// the request it is currently handling
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -244,5 +506,8 @@ func main() {
 	if err := api.GetMetricsServer().Shutdown(ctx); err != nil {
 		logger.Fatal(fmt.Sprintf("Metrics server forced to shutdown: %s", err))
 	}
+	if err := decisionLog.Close(); err != nil {
+		logger.Error(fmt.Sprintf("Error closing placement log: %s", err))
+	}
 	logger.Info("Target Exporter exiting")
 }
@@ -11,6 +11,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -24,7 +26,131 @@ type Config struct {
 	BmcNodeMappings   map[string]string  `yaml:"bmcNodeMappings"`
 	BmcUsername       string             `yaml:"bmcUsername"`
 	BmcPassword       string             `yaml:"bmcPassword"`
-	Setpoints         []float64          `yaml:"setpoints"`
+	// BmcProtocol is the default protocol used to talk to BMCs, "ipmi" (default) or "redfish"
+	BmcProtocol string `yaml:"bmcProtocol"`
+	// BmcProtocols overrides BmcProtocol per node name
+	BmcProtocols          map[string]string  `yaml:"bmcProtocols"`
+	BmcInsecureSkipVerify bool               `yaml:"bmcInsecureSkipVerify"`
+	Setpoints             []float64          `yaml:"setpoints"`
+	JobTemplates          JobTemplatesConfig `yaml:"jobTemplates"`
+	Placement             PlacementConfig    `yaml:"placement"`
+	Pyzhm                 PyzhmConfig        `yaml:"pyzhm"`
+	PlacementLog          PlacementLogConfig `yaml:"placementLog"`
+	ServerOnOff           ServerOnOffConfig  `yaml:"serverOnOff"`
+	Simulation            SimulationConfig   `yaml:"simulation"`
+	BmcMonitor            BmcMonitorConfig   `yaml:"bmcMonitor"`
+	Thermal               ThermalConfig      `yaml:"thermal"`
+	// Strategies overrides the interval, parameters and whether they are enabled on startup of strategies by name, e.g.
+	// "selfDriving" or "tawa". Only schedulable is enabled by default, serverOnOff has to be enabled here or through
+	// the API
+	Strategies     map[string]StrategyConfig `yaml:"strategies"`
+	Arbitration    ArbitrationConfig         `yaml:"arbitration"`
+	State          StateConfig               `yaml:"state"`
+	LeaderElection LeaderElectionConfig      `yaml:"leaderElection"`
+}
+
+// LeaderElectionConfig enables leader election through a Lease (named "target-exporter" by default), so that only
+// the leader replica runs the strategies. It requires the state to be persisted in a ConfigMap, from which the
+// followers also load the gauges of the leader every gaugeSyncInterval (5s by default).
+type LeaderElectionConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	LeaseName         string        `yaml:"leaseName"`
+	GaugeSyncInterval time.Duration `yaml:"gaugeSyncInterval"`
+}
+
+// StateConfig sets where the enabled strategies and their settings are persisted, to be restored on restart: a
+// ConfigMap of the namespace or a local file. The saved state takes precedence over the enabled flags of the
+// strategies config.
+type StateConfig struct {
+	ConfigMap string `yaml:"configMap"`
+	File      string `yaml:"file"`
+}
+
+// ArbitrationConfig sets how strategies mutating the same resources are arbitrated. ConflictPolicy is "warn" (default)
+// to only log when conflicting strategies are started together, or "reject" to refuse it. MutationWindow is how long
+// a resource of a node mutated by a strategy cannot be mutated by another one, 10s by default.
+type ArbitrationConfig struct {
+	ConflictPolicy string        `yaml:"conflictPolicy"`
+	MutationWindow time.Duration `yaml:"mutationWindow"`
+}
+
+// StrategyConfig sets the time between two reconciliations of a strategy, plus a random delay in [0, jitter), and
+// whether it is enabled on startup. Only the schedulable strategy is enabled by default. Parameters are the initial
+// parameters of the strategy, with the same fields as in the strategies API.
+type StrategyConfig struct {
+	Interval   time.Duration          `yaml:"interval"`
+	Jitter     time.Duration          `yaml:"jitter"`
+	Enabled    *bool                  `yaml:"enabled"`
+	Parameters map[string]interface{} `yaml:"parameters"`
+}
+
+// ThermalConfig sets the temperature thresholds, in Celsius, of the thermal strategy, a zero threshold is ignored.
+// Temperatures are read from the BMCs unless inletQuery or cpuQuery are set, in which case they are Prometheus queries
+// returning temperatures labelled by nodeLabel (default "node").
+type ThermalConfig struct {
+	InletHigh     float64            `yaml:"inletHigh"`
+	InletCritical float64            `yaml:"inletCritical"`
+	CpuHigh       float64            `yaml:"cpuHigh"`
+	CpuCritical   float64            `yaml:"cpuCritical"`
+	Hysteresis    float64            `yaml:"hysteresis"`
+	SideOffsets   map[string]float64 `yaml:"sideOffsets"`
+	InletQuery    string             `yaml:"inletQuery"`
+	CpuQuery      string             `yaml:"cpuQuery"`
+	NodeLabel     string             `yaml:"nodeLabel"`
+}
+
+// BmcMonitorConfig sets how often the BMC sensors and System Event Logs are polled, the default is every minute.
+type BmcMonitorConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Disabled bool          `yaml:"disabled"`
+}
+
+// SimulationConfig tunes the simulated server switches used with the "simulated" BMC protocol. If TaintNodes is set,
+// the nodes of powered off servers are tainted so that they look gone.
+type SimulationConfig struct {
+	BootDelay     time.Duration `yaml:"bootDelay"`
+	ShutdownDelay time.Duration `yaml:"shutdownDelay"`
+	TaintNodes    bool          `yaml:"taintNodes"`
+}
+
+// ServerOnOffConfig tunes the server on/off strategy, zero values keep the defaults. Efficiency is a score per node
+// name (e.g. cores per watt), the most efficient powered off server is turned on first.
+type ServerOnOffConfig struct {
+	BootTimeout time.Duration      `yaml:"bootTimeout"`
+	MinOnTime   time.Duration      `yaml:"minOnTime"`
+	Efficiency  map[string]float64 `yaml:"efficiency"`
+}
+
+// PlacementLogConfig sets how many placement decisions are kept in memory and an optional JSONL file receiving all of
+// them.
+type PlacementLogConfig struct {
+	Size int    `yaml:"size"`
+	File string `yaml:"file"`
+}
+
+// PyzhmConfig tunes the pyzhm client, zero values keep the client defaults. Durations are strings like "10s".
+type PyzhmConfig struct {
+	Timeout          time.Duration `yaml:"timeout"`
+	Retries          *int          `yaml:"retries"`
+	RetryBackoff     time.Duration `yaml:"retryBackoff"`
+	FailureThreshold int           `yaml:"failureThreshold"`
+	OpenTimeout      time.Duration `yaml:"openTimeout"`
+	HealthPath       string        `yaml:"healthPath"`
+	HealthInterval   time.Duration `yaml:"healthInterval"`
+}
+
+// PlacementConfig selects the placer used by TAWA, "pyzhm" (default) or "greedy". Unless disabled, the greedy placer
+// is used as fallback when pyzhm fails.
+type PlacementConfig struct {
+	Placer          string `yaml:"placer"`
+	DisableFallback bool   `yaml:"disableFallback"`
+}
+
+// JobTemplatesConfig declares where additional job templates are loaded from. Templates are named after their file
+// name or ConfigMap key, a template named "stress" overrides the built-in one.
+type JobTemplatesConfig struct {
+	Dir        string   `yaml:"dir"`
+	ConfigMaps []string `yaml:"configMaps"`
 }
 
 type TargetExporter struct {
@@ -36,15 +162,16 @@ type TargetExporter struct {
 	kubeClient   *kubeclient.Kubeclient
 	pyzhmClient  *pyzhm.PyzhmClient
 
-	o                 *Orchestrator
-	automaticJobSpawn *AutomaticJobSpawn
-	apiSrv            *http.Server
-	targets           map[string]*Target
-	schedulable       map[string]*Schedulable
+	o           *Orchestrator
+	apiSrv      *http.Server
+	targets     map[string]*Target
+	schedulable map[string]*Schedulable
+	// leader is whether this replica is the leader, always true without leader election
+	leader atomic.Bool
 }
 
 func NewTargetExporter(promClient *promclient.Promclient, kubeClient *kubeclient.Kubeclient, pyzhmClient *pyzhm.PyzhmClient, metricsSrv *http.Server, bootCfg Config, corsDisabled bool, logger *zap.Logger) *TargetExporter {
-	return &TargetExporter{
+	t := &TargetExporter{
 		promClient:   promClient,
 		kubeClient:   kubeClient,
 		pyzhmClient:  pyzhmClient,
@@ -55,6 +182,8 @@ func NewTargetExporter(promClient *promclient.Promclient, kubeClient *kubeclient
 		targets:      make(map[string]*Target), // basic cache for the targets, source of truth is in Prometheus TSDB
 		schedulable:  make(map[string]*Schedulable),
 	}
+	t.leader.Store(true)
+	return t
 }
 
 func (t *TargetExporter) StartMetrics() {
@@ -149,10 +278,6 @@ func (t *TargetExporter) SetOrchestrator(o *Orchestrator) {
 	t.o = o
 }
 
-func (t *TargetExporter) SetAutomaticJobSpawn(spawn *AutomaticJobSpawn) {
-	t.automaticJobSpawn = spawn
-}
-
 // Helper function to find missing nodes from one map where key is node name, and a map of node names to *Target.
 // Returns nil if no missing nodes were found.
 func checkMissingNodes(targets map[string]*Target, targetsToCheck map[string]float64) []string {
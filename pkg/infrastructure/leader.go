@@ -0,0 +1,107 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	. "git.helio.dev/eco-qube/target-exporter/pkg/scheduling"
+	"go.uber.org/zap"
+	"reflect"
+	"time"
+)
+
+// DefaultGaugeSyncInterval is how often the leader saves its gauges and the followers load them.
+const DefaultGaugeSyncInterval = 5 * time.Second
+
+// GaugesState are the targets and schedulable gauges exported by the leader, for the followers to export the same.
+type GaugesState struct {
+	Targets     map[string]float64 `json:"targets"`
+	Schedulable map[string]bool    `json:"schedulable"`
+}
+
+// SetLeader sets whether this replica is the leader. Followers only serve read requests.
+func (t *TargetExporter) SetLeader(leader bool) {
+	t.leader.Store(leader)
+}
+
+func (t *TargetExporter) IsLeader() bool {
+	return t.leader.Load()
+}
+
+// SyncGauges keeps the gauges of all replicas in sync until ctx is done: the leader saves its targets and schedulable
+// gauges whenever they change, the followers load them and export the same values.
+func (t *TargetExporter) SyncGauges(ctx context.Context, store StateStore, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultGaugeSyncInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var saved GaugesState
+		for {
+			if t.IsLeader() {
+				current := t.gaugesState()
+				if !reflect.DeepEqual(current, saved) {
+					if err := t.saveGauges(store, current); err != nil {
+						t.logger.Error("error saving gauges", zap.Error(err))
+					} else {
+						saved = current
+					}
+				}
+			} else {
+				saved = GaugesState{}
+				if err := t.loadGauges(store); err != nil {
+					t.logger.Error("error loading the gauges of the leader", zap.Error(err))
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (t *TargetExporter) gaugesState() GaugesState {
+	state := GaugesState{
+		Targets:     make(map[string]float64),
+		Schedulable: make(map[string]bool),
+	}
+	for nodeName, target := range t.targets {
+		state.Targets[nodeName] = target.GetTarget()
+	}
+	for nodeName, schedulable := range t.schedulable {
+		state.Schedulable[nodeName] = schedulable.IsSchedulable()
+	}
+	return state
+}
+
+func (t *TargetExporter) saveGauges(store StateStore, state GaugesState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return store.Save(data)
+}
+
+func (t *TargetExporter) loadGauges(store StateStore) error {
+	data, err := store.Load()
+	if err != nil || data == nil {
+		return err
+	}
+	state := GaugesState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for nodeName, value := range state.Targets {
+		if target, ok := t.targets[nodeName]; ok && target.GetTarget() != value {
+			target.Set(value)
+		}
+	}
+	for nodeName, value := range state.Schedulable {
+		if schedulable, ok := t.schedulable[nodeName]; ok {
+			schedulable.Set(value)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package infrastructure
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
@@ -10,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -30,6 +32,9 @@ type Workload struct {
 	NodeName       string  `json:"nodeName"`
 	CpuTarget      int     `json:"cpuTarget"`
 	MinCpuLimit    float64 `json:"minCpuLimit"`
+	MaxCpuLimit    float64 `json:"maxCpuLimit,omitempty"`
+	Priority       int     `json:"priority"`
+	Weight         float64 `json:"weight"`
 }
 
 type WorkloadsList struct {
@@ -40,30 +45,37 @@ type WorkloadRequest struct {
 	PodName      string                    `json:"podName,omitempty"`
 	CpuTarget    int                       `json:"cpuTarget"`
 	MinCpuLimit  float64                   `json:"minCpuLimit"`
+	MaxCpuLimit  float64                   `json:"maxCpuLimit,omitempty"`
 	JobLength    int                       `json:"jobLength"`
 	CpuCount     int                       `json:"cpuCount"`
 	WorkloadType kubeclient.HardwareTarget `json:"workloadType"`
 	Scenario     map[string]float64        `json:"scenario,omitempty"`
+	Template     string                    `json:"template,omitempty"`
+	Priority     int                       `json:"priority"`
+	Weight       float64                   `json:"weight,omitempty"`
+	Deadline     time.Time                 `json:"deadline,omitempty"`
 }
 
-type enabled struct {
-	Enabled bool `json:"enabled"`
+type TemplatesResponse struct {
+	Templates []string `json:"templates"`
 }
 
-type SelfDrivingRequest struct {
-	enabled
-}
-
-type SchedulableRequest struct {
-	enabled
+type enabled struct {
+	Enabled bool `json:"enabled"`
 }
 
-type TawaRequest struct {
-	enabled
+// StrategyRequest starts or stops a strategy and changes its settings, fields not set are left unchanged. Interval
+// and jitter are durations like "10s", parameters depend on the strategy.
+type StrategyRequest struct {
+	Enabled    *bool           `json:"enabled,omitempty"`
+	Interval   string          `json:"interval,omitempty"`
+	Jitter     string          `json:"jitter,omitempty"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
 }
 
-type AutomaticJobSpawnRequest struct {
-	enabled
+type StrategyResponse struct {
+	scheduling.StrategyStats
+	Parameters interface{} `json:"parameters,omitempty"`
 }
 
 type JobScenarioSpawnRequest struct {
@@ -73,6 +85,11 @@ type JobScenarioSpawnRequest struct {
 	WorkersCount int       `json:"workersCount"`
 	StartDate    time.Time `json:"startDate"`
 	MinCpuLimit  float64   `json:"minCpuLimit"`
+	MaxCpuLimit  float64   `json:"maxCpuLimit,omitempty"`
+	Template     string    `json:"template,omitempty"`
+	Priority     int       `json:"priority"`
+	Weight       float64   `json:"weight,omitempty"`
+	Deadline     time.Time `json:"deadline,omitempty"`
 }
 
 func (t *TargetExporter) StartApi() {
@@ -94,6 +111,7 @@ func (t *TargetExporter) StartApi() {
 	if t.corsDisabled {
 		r.Use(middlewares.CorsDisabled)
 	}
+	r.Use(middlewares.ReadOnlyUnless(t.IsLeader))
 	v1 := r.Group("/api/v1")
 	{
 		v1.GET("/targets", t.getTargetsResponse)
@@ -105,26 +123,39 @@ func (t *TargetExporter) StartApi() {
 		v1.DELETE("/workloads/completed", t.deleteWorkloadsCompleted)
 		v1.DELETE("/workloads/pending/last", t.deleteWorkloadsPendingLast)
 
+		v1.GET("/templates", t.getTemplates)
+
+		v1.GET("/queue", t.getQueue)
+		v1.GET("/placements", t.getPlacements)
+
 		v1.GET("/actualCpuUsageByRangeSeconds", t.getCpuUsageByRangeSeconds)
 		v1.GET("/actualCpuDiff", t.getCurrentCpuDiff)
 
-		v1.GET("/self-driving", t.getSelfDriving)
-		v1.PUT("/self-driving", t.putSelfDriving)
+		v1.GET("/strategies", t.getStrategies)
+		v1.GET("/strategies/:name", t.getStrategy)
+		v1.PUT("/strategies/:name", t.putStrategy)
+
+		v1.GET("/self-driving", t.getStrategyEnabled("selfDriving"))
+		v1.PUT("/self-driving", t.putStrategyEnabled("selfDriving"))
+		v1.GET("/self-driving/recommendations", t.getSelfDrivingRecommendations)
 
-		v1.GET("/tawa", t.getTawa)
-		v1.PUT("/tawa", t.putTawa)
+		v1.GET("/tawa", t.getStrategyEnabled("tawa"))
+		v1.PUT("/tawa", t.putStrategyEnabled("tawa"))
 
-		v1.GET("/schedulable", t.getSchedulable)
-		v1.PUT("/schedulable", t.putSchedulable)
+		v1.GET("/schedulable", t.getStrategyEnabled("schedulable"))
+		v1.PUT("/schedulable", t.putStrategyEnabled("schedulable"))
 
-		v1.GET("/automatic-job-spawn", t.getAutomaticJobSpawn)
-		v1.PUT("/automatic-job-spawn", t.putAutomaticJobSpawn)
+		v1.GET("/automatic-job-spawn", t.getStrategyEnabled("automaticJobSpawn"))
+		v1.PUT("/automatic-job-spawn", t.putStrategyEnabled("automaticJobSpawn"))
 
 		v1.GET("/server-on-off", t.getServerOnOff)
-		v1.PUT("/server-on-off", t.putServerOnOff)
+		v1.PUT("/server-on-off", t.putStrategyEnabled("serverOnOff"))
 
-		v1.GET("/reduce-targets", t.getReduceTargets)
-		v1.PUT("/reduce-targets", t.putReduceTargets)
+		v1.GET("/thermal", t.getStrategyEnabled("thermal"))
+		v1.PUT("/thermal", t.putStrategyEnabled("thermal"))
+
+		v1.GET("/reduce-targets", t.getStrategyEnabled("reduceTargets"))
+		v1.PUT("/reduce-targets", t.putStrategyEnabled("reduceTargets"))
 
 		v1.POST("/job-scenario", t.postJobScenario)
 	}
@@ -171,6 +202,21 @@ func (t *TargetExporter) getWorkloads(g *gin.Context) {
 			g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		maxCpuLimit, err := kubeclient.GetMaxCpu(pod)
+		if err != nil {
+			g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		priority, err := kubeclient.GetPriority(pod)
+		if err != nil {
+			g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		weight, err := kubeclient.GetWeight(pod)
+		if err != nil {
+			g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
 		workloads[i] = Workload{
 			Name:           pod.Name,
@@ -179,6 +225,9 @@ func (t *TargetExporter) getWorkloads(g *gin.Context) {
 			NodeName:       pod.Spec.NodeName,
 			CpuTarget:      int(target),
 			MinCpuLimit:    minCpuLimit,
+			MaxCpuLimit:    maxCpuLimit,
+			Priority:       priority,
+			Weight:         weight,
 		}
 	}
 	g.JSON(http.StatusOK, WorkloadsList{Workloads: workloads})
@@ -255,20 +304,57 @@ func (t *TargetExporter) postWorkloads(g *gin.Context) {
 		scheduling.CpuTarget(payload.CpuTarget),
 		scheduling.JobLength(payload.JobLength),
 		scheduling.MinCpuLimit(payload.MinCpuLimit),
+		scheduling.MaxCpuLimit(payload.MaxCpuLimit),
 		scheduling.CpuCount(payload.CpuCount),
 		scheduling.WorkloadType(string(payload.WorkloadType)),
+		scheduling.TemplateName(payload.Template),
+		scheduling.Priority(payload.Priority),
+		scheduling.Weight(payload.Weight),
+		scheduling.Deadline(payload.Deadline),
 	}
 
-	if err := t.o.AddWorkload(opts...); err != nil {
+	id, err := t.o.AddWorkload(opts...)
+	if err != nil {
 		g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	g.JSON(http.StatusOK, gin.H{
 		"message": "success",
+		"id":      id,
 	})
 }
 
+func (t *TargetExporter) getSelfDrivingRecommendations(g *gin.Context) {
+	g.JSON(http.StatusOK, gin.H{"recommendations": t.o.SelfDrivingRecommendations()})
+}
+
+func (t *TargetExporter) getQueue(g *gin.Context) {
+	g.JSON(http.StatusOK, t.o.Queue())
+}
+
+// getPlacements returns the placement decisions, newest first. Optional query parameters: limit, jobName, outcome.
+func (t *TargetExporter) getPlacements(g *gin.Context) {
+	limit := 0
+	if g.Query("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(g.Query("limit")); err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	jobName, outcome := g.Query("jobName"), g.Query("outcome")
+	placements := t.o.Placements(limit, func(decision scheduling.PlacementDecision) bool {
+		return (jobName == "" || decision.JobName == jobName) &&
+			(outcome == "" || string(decision.Outcome) == outcome)
+	})
+	g.JSON(http.StatusOK, gin.H{"placements": placements})
+}
+
+func (t *TargetExporter) getTemplates(g *gin.Context) {
+	g.JSON(http.StatusOK, TemplatesResponse{Templates: t.o.JobTemplateNames()})
+}
+
 func (t *TargetExporter) patchWorkload(g *gin.Context) {
 	// TODO: Currently only supports patching of CPU limits
 	payload := WorkloadRequest{}
@@ -339,141 +425,188 @@ func (t *TargetExporter) getCurrentCpuDiff(g *gin.Context) {
 	g.JSON(http.StatusOK, cpuDiff)
 }
 
-func (t *TargetExporter) getSelfDriving(g *gin.Context) {
+// getStrategies returns the state and reconciliation statistics of every strategy.
+func (t *TargetExporter) getStrategies(g *gin.Context) {
 	g.JSON(http.StatusOK, gin.H{
-		"enabled": t.o.IsSelfDrivingEnabled(),
+		"strategies": t.o.Strategies().Stats(),
 	})
 }
 
-func (t *TargetExporter) putSelfDriving(g *gin.Context) {
-	payload := SelfDrivingRequest{}
-	if err := g.BindJSON(&payload); err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// getStrategy returns the state, statistics and parameters of a strategy.
+func (t *TargetExporter) getStrategy(g *gin.Context) {
+	name := g.Param("name")
+	strategy, err := t.o.Strategies().Get(name)
+	if err != nil {
+		g.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-
-	if payload.Enabled {
-		t.o.StartSelfDriving()
-	} else {
-		t.o.StopSelfDriving()
+	parameters, err := t.o.Strategies().Parameters(name)
+	if err != nil {
+		g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	g.JSON(http.StatusOK, gin.H{
-		"message": "success",
+	g.JSON(http.StatusOK, StrategyResponse{
+		StrategyStats: strategy.Stats(),
+		Parameters:    parameters,
 	})
 }
 
-func (t *TargetExporter) getSchedulable(g *gin.Context) {
-	g.JSON(http.StatusOK, gin.H{
-		"enabled": t.o.IsSchedulableEnabled(),
-	})
-}
-
-func (t *TargetExporter) putSchedulable(g *gin.Context) {
-	payload := SchedulableRequest{}
-	if err := g.BindJSON(&payload); err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// putStrategy starts or stops a strategy and updates its interval and parameters, fields not set are left unchanged.
+// The request is checked before anything is applied, so that a rejected start leaves the strategy unchanged.
+func (t *TargetExporter) putStrategy(g *gin.Context) {
+	name := g.Param("name")
+	strategy, err := t.o.Strategies().Get(name)
+	if err != nil {
+		g.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-
-	if payload.Enabled {
-		t.o.StartSchedulable()
-	} else {
-		t.o.StopSchedulable()
-	}
-	g.JSON(http.StatusOK, gin.H{
-		"message": "success",
-	})
-}
-
-func (t *TargetExporter) getTawa(g *gin.Context) {
-	g.JSON(http.StatusOK, gin.H{
-		"enabled": t.o.IsTawaEnabled(),
-	})
-}
-
-func (t *TargetExporter) putTawa(g *gin.Context) {
-	payload := TawaRequest{}
+	payload := StrategyRequest{}
 	if err := g.BindJSON(&payload); err != nil {
 		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if payload.Enabled {
-		t.o.StartTawa()
-	} else {
-		t.o.StopTawa()
+	var interval, jitter time.Duration
+	setInterval := payload.Interval != "" || payload.Jitter != ""
+	if setInterval {
+		stats := strategy.Stats()
+		intervalValue, jitterValue := stats.Interval, stats.Jitter
+		if payload.Interval != "" {
+			intervalValue = payload.Interval
+		}
+		if payload.Jitter != "" {
+			jitterValue = payload.Jitter
+		}
+		if interval, jitter, err = parseStrategyInterval(intervalValue, jitterValue); err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
-	g.JSON(http.StatusOK, gin.H{
-		"message": "success",
-	})
-}
-
-func (t *TargetExporter) getAutomaticJobSpawn(g *gin.Context) {
-	g.JSON(http.StatusOK, gin.H{
-		"enabled": t.automaticJobSpawn.IsAutomaticJobSpawnEnabled(),
-	})
-}
-
-func (t *TargetExporter) putAutomaticJobSpawn(g *gin.Context) {
-	payload := AutomaticJobSpawnRequest{}
-	if err := g.BindJSON(&payload); err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	conflicts := make([]scheduling.Conflict, 0)
+	if payload.Enabled != nil {
+		if *payload.Enabled {
+			if conflicts, err = t.o.Strategies().CheckStart(name); err != nil {
+				g.JSON(strategyErrorStatus(err, http.StatusConflict), gin.H{"error": err.Error(), "conflicts": conflicts})
+				return
+			}
+		} else if strategy.Stats().Internal {
+			err = fmt.Errorf("%w: %s", scheduling.ErrStrategyInternal, name)
+			g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	if payload.Enabled {
-		t.automaticJobSpawn.Start()
-	} else {
-		t.automaticJobSpawn.Stop()
+	if len(payload.Parameters) > 0 {
+		if err := t.o.Strategies().SetParameters(name, payload.Parameters); err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if setInterval {
+		if err := t.o.SetStrategyInterval(name, interval, jitter); err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if payload.Enabled != nil {
+		if *payload.Enabled {
+			conflicts, err = t.o.Strategies().Start(name)
+			if err != nil {
+				g.JSON(strategyErrorStatus(err, http.StatusConflict), gin.H{"error": err.Error(), "conflicts": conflicts})
+				return
+			}
+		} else if err = t.o.Strategies().Stop(name); err != nil {
+			g.JSON(strategyErrorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+			return
+		}
 	}
 	g.JSON(http.StatusOK, gin.H{
-		"message": "success",
+		"message":   "success",
+		"conflicts": conflicts,
 	})
 }
 
-func (t *TargetExporter) getServerOnOff(g *gin.Context) {
-	g.JSON(http.StatusOK, gin.H{
-		"enabled": t.o.IsServerOnOffEnabled(),
-	})
+// parseStrategyInterval parses and validates the interval and jitter of a strategy.
+func parseStrategyInterval(interval, jitter string) (time.Duration, time.Duration, error) {
+	intervalDuration, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	jitterDuration, err := time.ParseDuration(jitter)
+	if err != nil {
+		return 0, 0, err
+	}
+	if intervalDuration <= 0 || jitterDuration < 0 {
+		return 0, 0, fmt.Errorf("invalid interval %s or jitter %s", interval, jitter)
+	}
+	return intervalDuration, jitterDuration, nil
 }
 
-func (t *TargetExporter) putServerOnOff(g *gin.Context) {
-	payload := SchedulableRequest{}
-	if err := g.BindJSON(&payload); err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// strategyErrorStatus returns the HTTP status of an error starting or stopping a strategy, status if not specific.
+func strategyErrorStatus(err error, status int) int {
+	if errors.Is(err, scheduling.ErrStrategyInternal) {
+		return http.StatusBadRequest
 	}
+	return status
+}
 
-	if payload.Enabled {
-		t.o.StartServerOnOff()
-	} else {
-		t.o.StopServerOnOff()
+// getStrategyEnabled returns whether a strategy is running, for the per-strategy endpoints predating
+// /strategies/{name}.
+func (t *TargetExporter) getStrategyEnabled(name string) gin.HandlerFunc {
+	return func(g *gin.Context) {
+		strategy, err := t.o.Strategies().Get(name)
+		if err != nil {
+			g.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		g.JSON(http.StatusOK, gin.H{
+			"enabled": strategy.IsRunning(),
+		})
 	}
-	g.JSON(http.StatusOK, gin.H{
-		"message": "success",
-	})
 }
 
-func (t *TargetExporter) getReduceTargets(g *gin.Context) {
-	g.JSON(http.StatusOK, gin.H{
-		"enabled": t.o.IsReduceTargetsEnabled(),
-	})
-}
+// putStrategyEnabled starts or stops a strategy, for the per-strategy endpoints predating /strategies/{name}.
+func (t *TargetExporter) putStrategyEnabled(name string) gin.HandlerFunc {
+	return func(g *gin.Context) {
+		if _, err := t.o.Strategies().Get(name); err != nil {
+			g.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		payload := enabled{}
+		if err := g.BindJSON(&payload); err != nil {
+			g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-func (t *TargetExporter) putReduceTargets(g *gin.Context) {
-	payload := SchedulableRequest{}
-	if err := g.BindJSON(&payload); err != nil {
-		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		var err error
+		conflicts := make([]scheduling.Conflict, 0)
+		if payload.Enabled {
+			conflicts, err = t.o.Strategies().Start(name)
+			if err != nil {
+				g.JSON(strategyErrorStatus(err, http.StatusConflict), gin.H{"error": err.Error(), "conflicts": conflicts})
+				return
+			}
+		} else if err = t.o.Strategies().Stop(name); err != nil {
+			g.JSON(strategyErrorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+			return
+		}
+		g.JSON(http.StatusOK, gin.H{
+			"message":   "success",
+			"conflicts": conflicts,
+		})
 	}
+}
 
-	if payload.Enabled {
-		t.o.StartReduceTargets()
-	} else {
-		t.o.StopReduceTargets()
+func (t *TargetExporter) getServerOnOff(g *gin.Context) {
+	strategy, err := t.o.Strategies().Get("serverOnOff")
+	if err != nil {
+		g.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
 	}
 	g.JSON(http.StatusOK, gin.H{
-		"message": "success",
+		"enabled": strategy.IsRunning(),
+		"servers": t.o.ServerStates(),
+		"bmcs":    t.o.BmcStatuses(),
 	})
 }
 
@@ -484,18 +617,30 @@ func (t *TargetExporter) postJobScenario(g *gin.Context) {
 		return
 	}
 
-	for _, job := range payload {
-		err := t.o.AddWorkload(
+	// The whole scenario is submitted as one batch so that it is placed and co-optimized together
+	batch := make([][]scheduling.WorkloadSpawnOption, len(payload))
+	for i, job := range payload {
+		batch[i] = []scheduling.WorkloadSpawnOption{
 			scheduling.JobName(job.JobName),
 			scheduling.JobLength(job.JobLength),
 			scheduling.CpuTarget(job.JobTarget),
 			scheduling.CpuCount(job.WorkersCount),
 			scheduling.StartDate(job.StartDate),
 			scheduling.MinCpuLimit(job.MinCpuLimit),
-		)
-		if err != nil {
-			g.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			scheduling.MaxCpuLimit(job.MaxCpuLimit),
+			scheduling.TemplateName(job.Template),
+			scheduling.Priority(job.Priority),
+			scheduling.Weight(job.Weight),
+			scheduling.Deadline(job.Deadline),
 		}
 	}
+	ids, err := t.o.AddWorkloads(batch...)
+	if err != nil {
+		g.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	g.JSON(http.StatusOK, gin.H{
+		"message": "success",
+		"ids":     ids,
+	})
 }
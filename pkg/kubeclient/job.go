@@ -1,12 +1,12 @@
 package kubeclient
 
 import (
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	v1batch "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/apimachinery/pkg/util/yaml"
 	"strconv"
 	"strings"
 	"time"
@@ -14,21 +14,40 @@ import (
 
 type HardwareTarget string
 
+// ErrInvalidJob is returned when a Job cannot be rendered from its template.
+var ErrInvalidJob = errors.New("invalid job")
+
 const HardwareTypeAnnotation = "ecoqube.eu/hardware-type"
 const JobStartDateAnnotation = "ecoqube.eu/start"
 const JobMinCpuLimitAnnotation = "ecoqube.eu/min-cpu-limit"
 
+// JobPriorityAnnotation is the priority of a job, its pods are throttled after those of lower priority jobs and relaxed
+// before them
+const JobPriorityAnnotation = "ecoqube.eu/priority"
+
+// JobMaxCpuLimitAnnotation is the percentage up to which the CPU limit of a job is relaxed
+const JobMaxCpuLimitAnnotation = "ecoqube.eu/max-cpu-limit"
+
+// JobWeightAnnotation is the weight of a job among the jobs of the same priority, its pods take a part of the
+// throttling and relaxing proportional to it
+const JobWeightAnnotation = "ecoqube.eu/weight"
+
+// RecommendedCpuLimitAnnotation is the CPU limit recommended for a pod by the self-driving strategy in recommend-only
+// mode
+const RecommendedCpuLimitAnnotation = "ecoqube.eu/recommended-cpu-limit"
+
 const (
 	CpuIntensive     HardwareTarget = "cpu"
 	StorageIntensive HardwareTarget = "storage"
 	MemoryIntensive  HardwareTarget = "memory"
 )
 
+// StressJobPrototype is the built-in "stress" job template, see JobTemplateParams for the available parameters.
 const StressJobPrototype = `
 apiVersion: batch/v1
 kind: Job
 metadata:
-  name: cpu-stress-job-proto
+  name: {{ .Name }}
   namespace: default
 spec:
   template:
@@ -51,14 +70,14 @@ spec:
           imagePullPolicy: IfNotPresent
           env:
             - name: MAX_CPU_CORES
-              value: '1'
+              value: '{{ .CpuCount }}'
             - name: STRESS_SYSTEM_FOR
-              value: 1m
+              value: {{ .LengthMinutes }}m
           resources:
             requests:
-              cpu: 250m
+              cpu: {{ .CpuRequest }}
             limits:
-              cpu: 250m
+              cpu: {{ .CpuLimit }}
               telemetry/scheduling: "1"
       restartPolicy: Never
   backoffLimit: 4
@@ -73,6 +92,10 @@ type JobBuilder interface {
 	WithNodeSelector(string) JobBuilder
 	WithStartDate(time.Time) JobBuilder
 	WithMinCpuLimit(float64) JobBuilder
+	WithMaxCpuLimit(float64) JobBuilder
+	WithPriority(int) JobBuilder
+	WithWeight(float64) JobBuilder
+	WithTemplate(*JobTemplate) JobBuilder
 	Build() (*StressJob, error)
 }
 
@@ -94,13 +117,17 @@ type BaseJob struct {
 	nodeSelector map[string]string
 	startDate    time.Time
 	minCpuLimit  float64
+	maxCpuLimit  float64
+	priority     int
+	weight       float64
 
 	k8sJob *v1batch.Job
 }
 
 type StressJob struct {
 	BaseJob
-	length time.Duration
+	length   time.Duration
+	template *JobTemplate
 }
 
 type StressJobBuilder struct {
@@ -151,11 +178,44 @@ func (builder *StressJobBuilder) WithMinCpuLimit(minCpuLimit float64) JobBuilder
 	return builder
 }
 
+// WithMaxCpuLimit sets the percentage up to which the CPU limit is relaxed, 0 for no maximum.
+func (builder *StressJobBuilder) WithMaxCpuLimit(maxCpuLimit float64) JobBuilder {
+	builder.job.maxCpuLimit = maxCpuLimit
+	return builder
+}
+
+func (builder *StressJobBuilder) WithPriority(priority int) JobBuilder {
+	builder.job.priority = priority
+	return builder
+}
+
+// WithWeight sets the weight of the job among the jobs of the same priority, 0 for the default weight.
+func (builder *StressJobBuilder) WithWeight(weight float64) JobBuilder {
+	builder.job.weight = weight
+	return builder
+}
+
+// WithTemplate sets the job template used to render the Job, if not set the built-in stress template is used.
+func (builder *StressJobBuilder) WithTemplate(template *JobTemplate) JobBuilder {
+	builder.job.template = template
+	return builder
+}
+
 func (builder *StressJobBuilder) Build() (*StressJob, error) {
-	// TODO: Validation
 	if builder.job.name == "" {
 		builder.job.name = generateJobName(builder.job.cpuLimit.String())
 	}
+	if builder.job.template == nil {
+		template, err := NewJobTemplate(DefaultJobTemplate, StressJobPrototype)
+		if err != nil {
+			return nil, err
+		}
+		builder.job.template = template
+	}
+	// Make sure the job renders before it is handed over
+	if _, err := builder.job.RenderK8sJob(); err != nil {
+		return nil, err
+	}
 	return builder.job, nil
 }
 
@@ -179,9 +239,15 @@ func (s *StressJob) GetWorkloadType() HardwareTarget {
 	return s.workloadType
 }
 
+func (s *StressJob) GetTemplateName() string {
+	if s.template == nil {
+		return DefaultJobTemplate
+	}
+	return s.template.Name
+}
+
 func (s *StressJob) RenderK8sJob() (*v1batch.Job, error) {
-	var job *v1batch.Job
-	err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(StressJobPrototype), len(StressJobPrototype)).Decode(&job)
+	job, err := s.template.Render(newJobTemplateParams(s.name, s.cpuLimit, s.cpuCount, s.length, s.nodeSelector))
 	if err != nil {
 		return nil, err
 	}
@@ -191,14 +257,21 @@ func (s *StressJob) RenderK8sJob() (*v1batch.Job, error) {
 	// TODO: What if there are multiple containers?
 	job.ObjectMeta.Name = s.name
 	labels := job.Spec.Template.ObjectMeta.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
 	labels["app"] = s.name
 	job.Spec.Template.ObjectMeta.SetLabels(labels)
-	job.Spec.Template.Spec.Containers[0].Resources.Limits["cpu"] = s.cpuLimit
-	job.Spec.Template.Spec.Containers[0].Resources.Requests["cpu"] = *resource.NewMilliQuantity(s.cpuLimit.MilliValue()/4, resource.DecimalSI)
-	job.Spec.Template.Spec.Containers[0].Env[0].Name = "MAX_CPU_CORES"
-	job.Spec.Template.Spec.Containers[0].Env[0].Value = strconv.Itoa(s.cpuCount)
-	job.Spec.Template.Spec.Containers[0].Env[1].Name = "STRESS_SYSTEM_FOR"
-	job.Spec.Template.Spec.Containers[0].Env[1].Value = fmt.Sprintf("%.0fm", s.length.Minutes())
+	// CPU limits are what the strategies act upon, so they are enforced regardless of the template
+	resources := &job.Spec.Template.Spec.Containers[0].Resources
+	if resources.Limits == nil {
+		resources.Limits = make(v1.ResourceList)
+	}
+	if resources.Requests == nil {
+		resources.Requests = make(v1.ResourceList)
+	}
+	resources.Limits["cpu"] = s.cpuLimit
+	resources.Requests["cpu"] = *resource.NewMilliQuantity(s.cpuLimit.MilliValue()/4, resource.DecimalSI)
 	// Ensure deadline
 	job.Spec.ActiveDeadlineSeconds = &deadline
 	if s.nodeSelector != nil {
@@ -230,6 +303,13 @@ func (s *StressJob) RenderK8sJob() (*v1batch.Job, error) {
 		annotations = make(map[string]string)
 	}
 	annotations[JobMinCpuLimitAnnotation] = fmt.Sprintf("%f", s.minCpuLimit)
+	annotations[JobPriorityAnnotation] = strconv.Itoa(s.priority)
+	if s.maxCpuLimit > 0 {
+		annotations[JobMaxCpuLimitAnnotation] = fmt.Sprintf("%f", s.maxCpuLimit)
+	}
+	if s.weight > 0 {
+		annotations[JobWeightAnnotation] = fmt.Sprintf("%f", s.weight)
+	}
 	job.Spec.Template.SetAnnotations(annotations)
 
 	return job, nil
@@ -239,6 +319,11 @@ func generateJobName(jobCpuLimit string) string {
 	return jobCpuLimit + "-cpu-stresstest-" + uuid.New().String()[0:8]
 }
 
+// NewJobName generates a unique job name starting with the given prefix.
+func NewJobName(prefix string) string {
+	return prefix + "-" + uuid.New().String()[0:8]
+}
+
 func MinutesToDuration(minutes int) time.Duration {
 	return time.Duration(minutes * int(time.Minute))
 }
@@ -256,3 +341,48 @@ func GetMinCpu(pod v1.Pod) (float64, error) {
 	}
 	return minCpuLimitFloat, nil
 }
+
+// GetMaxCpu returns the max-cpu-limit annotation of a pod, 0 if it is not set.
+func GetMaxCpu(pod v1.Pod) (float64, error) {
+	maxCpuLimit, ok := pod.Annotations[JobMaxCpuLimitAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	maxCpuLimitFloat, err := strconv.ParseFloat(maxCpuLimit, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse max cpu limit")
+	}
+	return maxCpuLimitFloat, nil
+}
+
+// DefaultWeight is the weight of the pods without weight annotation.
+const DefaultWeight = 1
+
+// GetWeight returns the weight annotation of a pod, DefaultWeight if it is not set.
+func GetWeight(pod v1.Pod) (float64, error) {
+	weight, ok := pod.Annotations[JobWeightAnnotation]
+	if !ok {
+		return DefaultWeight, nil
+	}
+	weightFloat, err := strconv.ParseFloat(weight, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse weight")
+	}
+	if weightFloat <= 0 {
+		return 0, fmt.Errorf("weight must be positive")
+	}
+	return weightFloat, nil
+}
+
+// GetPriority returns the priority annotation of a pod, 0 if it is not set.
+func GetPriority(pod v1.Pod) (int, error) {
+	priority, ok := pod.Annotations[JobPriorityAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	priorityInt, err := strconv.Atoi(priority)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse priority")
+	}
+	return priorityInt, nil
+}
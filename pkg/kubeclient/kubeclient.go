@@ -35,11 +35,21 @@ func NewKubeClient(client *kubernetes.Clientset, logger *zap.Logger) *Kubeclient
 	return &Kubeclient{client, logger, "default"}
 }
 
+// Namespace returns the namespace the client works in.
+func (kc *Kubeclient) Namespace() string {
+	return kc.ns
+}
+
 func (kc *Kubeclient) PatchCpuLimit(limit resource.Quantity, podName string) error {
 	kc.logger.Info("Patching Job limit", zap.String("name", podName),
 		zap.String("newLimit", limit.String()))
-	// Then patch the container's CPU limit
-	patch := fmt.Sprintf(`{"spec":{"containers":[{"name":"cpu-stress-job-proto", "resources":{"requests":{"cpu":"%s"}, "limits": {"cpu": "%s"}}}]}}`, limit.String(), limit.String())
+	pod, err := kc.GetPodFromName(podName)
+	if err != nil {
+		return err
+	}
+	// Then patch the container's CPU limit, containers are merged by name which depends on the job template
+	patch := fmt.Sprintf(`{"spec":{"containers":[{"name":"%s", "resources":{"requests":{"cpu":"%s"}, "limits": {"cpu": "%s"}}}]}}`,
+		pod.Spec.Containers[0].Name, limit.String(), limit.String())
 	patchedPod, err := kc.CoreV1().Pods(kc.ns).Patch(context.TODO(), podName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
 	if err != nil {
 		kc.logger.Error("Error patching pod", zap.Error(err))
@@ -49,6 +59,28 @@ func (kc *Kubeclient) PatchCpuLimit(limit resource.Quantity, podName string) err
 	return nil
 }
 
+// AnnotatePod sets the annotation of a pod, without changing its spec.
+func (kc *Kubeclient) AnnotatePod(podName, key, value string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, key, value)
+	_, err := kc.CoreV1().Pods(kc.ns).Patch(context.TODO(), podName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		kc.logger.Error("Error annotating pod", zap.String("name", podName), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// RemovePodAnnotation removes an annotation from a pod, if set.
+func (kc *Kubeclient) RemovePodAnnotation(podName, key string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, key)
+	_, err := kc.CoreV1().Pods(kc.ns).Patch(context.TODO(), podName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		kc.logger.Error("Error removing pod annotation", zap.String("name", podName), zap.String("key", key), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 func (kc *Kubeclient) GetPodsInNamespace() ([]v1.Pod, error) {
 	// https://github.com/kubernetes/client-go/blob/master/examples/out-of-cluster-client-configuration/main.go
 	// TODO: Make namespace configurable or get via label selection
@@ -83,7 +115,7 @@ func (kc *Kubeclient) SpawnNewWorkload(job *StressJob) error {
 	k8sJob, err := job.RenderK8sJob()
 	if err != nil {
 		kc.logger.Error("Error getting K8s Job", zap.Error(err))
-		return err
+		return fmt.Errorf("%w: %v", ErrInvalidJob, err)
 	}
 	kc.logger.Info("Spawning Job", zap.String("name", job.name))
 
@@ -97,6 +129,19 @@ func (kc *Kubeclient) SpawnNewWorkload(job *StressJob) error {
 	return nil
 }
 
+// DeleteWorkload deletes a Job and its Pods.
+func (kc *Kubeclient) DeleteWorkload(jobName string) error {
+	kc.logger.Info("Deleting Job", zap.String("name", jobName))
+	err := kc.BatchV1().Jobs(kc.ns).Delete(context.TODO(), jobName, metav1.DeleteOptions{
+		PropagationPolicy: &policy,
+	})
+	if err != nil {
+		kc.logger.Error("Error deleting Job", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 func (kc *Kubeclient) ClearCompletedWorkloads() (done bool, err error) {
 	kc.logger.Info("Clearing completed workloads")
 	jobs, err := kc.BatchV1().Jobs(kc.ns).List(context.TODO(), metav1.ListOptions{})
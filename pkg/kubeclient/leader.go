@@ -0,0 +1,50 @@
+package kubeclient
+
+import (
+	"context"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"time"
+)
+
+const (
+	LeaseDuration = 15 * time.Second
+	RenewDeadline = 10 * time.Second
+	RetryPeriod   = 2 * time.Second
+)
+
+// RunLeaderElection competes for the Lease of the namespace until ctx is done. onStartedLeading is called when this
+// replica becomes the leader, with a context cancelled when it stops leading, and onStoppedLeading once it lost the
+// lease, after which it competes again. The lease is released when ctx is done.
+func (kc *Kubeclient) RunLeaderElection(ctx context.Context, leaseName, identity string,
+	onStartedLeading func(ctx context.Context), onStoppedLeading func()) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: kc.ns,
+		},
+		Client: kc.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   LeaseDuration,
+			RenewDeadline:   RenewDeadline,
+			RetryPeriod:     RetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: onStartedLeading,
+				OnStoppedLeading: onStoppedLeading,
+				OnNewLeader: func(leader string) {
+					kc.logger.Info("leader elected", zap.String("leader", leader), zap.String("identity", identity))
+				},
+			},
+		})
+	}
+}
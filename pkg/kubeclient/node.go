@@ -0,0 +1,185 @@
+package kubeclient
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+// EvictionRetryInterval is how long to wait before retrying an eviction refused because of a PodDisruptionBudget.
+const EvictionRetryInterval = 5 * time.Second
+
+// CordonNode marks the node as unschedulable.
+func (kc *Kubeclient) CordonNode(nodeName string) error {
+	return kc.setUnschedulable(nodeName, true)
+}
+
+// UncordonNode marks the node as schedulable.
+func (kc *Kubeclient) UncordonNode(nodeName string) error {
+	return kc.setUnschedulable(nodeName, false)
+}
+
+func (kc *Kubeclient) setUnschedulable(nodeName string, unschedulable bool) error {
+	kc.logger.Info("Setting node unschedulable", zap.String("nodeName", nodeName), zap.Bool("unschedulable", unschedulable))
+	patch := fmt.Sprintf(`{"spec":{"unschedulable":%t}}`, unschedulable)
+	_, err := kc.CoreV1().Nodes().Patch(context.TODO(), nodeName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		kc.logger.Error("Error patching node", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// IsNodeReady returns whether the Ready condition of the node is true.
+func (kc *Kubeclient) IsNodeReady(nodeName string) (bool, error) {
+	node, err := kc.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
+
+// DrainNode evicts all pods running on the node, in all namespaces, except DaemonSet and mirror pods. Evictions go
+// through the Eviction API so PodDisruptionBudgets are respected: evictions refused because of a budget are retried
+// until timeout or until ctx is done. It returns once all evicted pods are gone.
+func (kc *Kubeclient) DrainNode(ctx context.Context, nodeName string, timeout time.Duration) error {
+	kc.logger.Info("Draining node", zap.String("nodeName", nodeName))
+	deadline := time.Now().Add(timeout)
+	for {
+		pods, err := kc.getDrainablePods(nodeName)
+		if err != nil {
+			return err
+		}
+		if len(pods) == 0 {
+			kc.logger.Info("Node drained", zap.String("nodeName", nodeName))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout draining node %s, %d pods left", nodeName, len(pods))
+		}
+		for _, pod := range pods {
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+			if err = kc.evictPod(pod); err != nil {
+				if errors.IsTooManyRequests(err) {
+					kc.logger.Info("Eviction refused by PodDisruptionBudget, retrying", zap.String("pod", pod.Name),
+						zap.String("namespace", pod.Namespace))
+					continue
+				}
+				if !errors.IsNotFound(err) {
+					kc.logger.Error("Error evicting pod", zap.String("pod", pod.Name), zap.Error(err))
+					return err
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("draining node %s: %w", nodeName, ctx.Err())
+		case <-time.After(EvictionRetryInterval):
+		}
+	}
+}
+
+func (kc *Kubeclient) evictPod(pod v1.Pod) error {
+	kc.logger.Info("Evicting pod", zap.String("pod", pod.Name), zap.String("namespace", pod.Namespace))
+	return kc.PolicyV1().Evictions(pod.Namespace).Evict(context.TODO(), &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+	})
+}
+
+// getDrainablePods returns the pods on the node that have to be evicted before the node can be turned off.
+func (kc *Kubeclient) getDrainablePods(nodeName string) ([]v1.Pod, error) {
+	pods, err := kc.CoreV1().Pods(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		kc.logger.Error("Error getting pods", zap.Error(err))
+		return nil, err
+	}
+	drainable := make([]v1.Pod, 0)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if _, isMirror := pod.Annotations[v1.MirrorPodAnnotationKey]; isMirror {
+			continue
+		}
+		if isOwnerKindPresent(pod.OwnerReferences, "DaemonSet") {
+			continue
+		}
+		drainable = append(drainable, pod)
+	}
+	return drainable, nil
+}
+
+// GetPendingPods returns the pods of the workloads namespace waiting to be scheduled.
+func (kc *Kubeclient) GetPendingPods() ([]v1.Pod, error) {
+	pods, err := kc.CoreV1().Pods(kc.ns).List(context.TODO(), metav1.ListOptions{FieldSelector: "status.phase=Pending"})
+	if err != nil {
+		kc.logger.Error("Error getting Pods", zap.Error(err))
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+func isOwnerKindPresent(ownerRefs []metav1.OwnerReference, kind string) bool {
+	for _, ownerRef := range ownerRefs {
+		if ownerRef.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// PoweredOffTaintKey is the NoExecute taint set on nodes of simulated servers that are powered off.
+const PoweredOffTaintKey = "ecoqube.eu/powered-off"
+
+// TaintNodePoweredOff adds the PoweredOffTaintKey NoExecute taint to the node, evicting its pods.
+func (kc *Kubeclient) TaintNodePoweredOff(nodeName string) error {
+	node, err := kc.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == PoweredOffTaintKey {
+			return nil
+		}
+	}
+	node.Spec.Taints = append(node.Spec.Taints, v1.Taint{Key: PoweredOffTaintKey, Effect: v1.TaintEffectNoExecute})
+	kc.logger.Info("Tainting node", zap.String("nodeName", nodeName), zap.String("taint", PoweredOffTaintKey))
+	_, err = kc.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{})
+	return err
+}
+
+// UntaintNodePoweredOff removes the PoweredOffTaintKey taint from the node.
+func (kc *Kubeclient) UntaintNodePoweredOff(nodeName string) error {
+	node, err := kc.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	taints := make([]v1.Taint, 0, len(node.Spec.Taints))
+	for _, taint := range node.Spec.Taints {
+		if taint.Key != PoweredOffTaintKey {
+			taints = append(taints, taint)
+		}
+	}
+	if len(taints) == len(node.Spec.Taints) {
+		return nil
+	}
+	node.Spec.Taints = taints
+	kc.logger.Info("Untainting node", zap.String("nodeName", nodeName), zap.String("taint", PoweredOffTaintKey))
+	_, err = kc.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,76 @@
+package kubeclient
+
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// StateKey is the key of the ConfigMap holding the state of the strategies
+	StateKey = "state.json"
+	// GaugesKey is the key of the ConfigMap holding the targets and schedulable gauges of the leader
+	GaugesKey = "gauges.json"
+)
+
+// ConfigMapStateStore keeps a state document in a key of a ConfigMap, which is created on first save.
+type ConfigMapStateStore struct {
+	kc   *Kubeclient
+	name string
+	key  string
+}
+
+func NewConfigMapStateStore(kc *Kubeclient, configMapName, key string) *ConfigMapStateStore {
+	return &ConfigMapStateStore{kc: kc, name: configMapName, key: key}
+}
+
+// Load returns the state document, nil if it was never saved.
+func (s *ConfigMapStateStore) Load() ([]byte, error) {
+	cm, err := s.kc.CoreV1().ConfigMaps(s.kc.ns).Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data[s.key]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(data), nil
+}
+
+// Save writes the state document, retrying when the ConfigMap was changed meanwhile, e.g. by the other store sharing
+// it.
+func (s *ConfigMapStateStore) Save(data []byte) error {
+	conflict := func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, conflict, func() error {
+		return s.save(data)
+	})
+}
+
+func (s *ConfigMapStateStore) save(data []byte) error {
+	configMaps := s.kc.CoreV1().ConfigMaps(s.kc.ns)
+	cm, err := configMaps.Get(context.TODO(), s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.name},
+			Data:       map[string]string{s.key: string(data)},
+		}
+		_, err = configMaps.Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[s.key] = string(data)
+	_, err = configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
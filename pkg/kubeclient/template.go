@@ -0,0 +1,218 @@
+package kubeclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	v1batch "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const DefaultJobTemplate = "stress"
+
+// JobTemplateParams are the values substituted into a job template before it is decoded into a batch/v1 Job.
+// Templates use the Go text/template syntax, e.g. {{ .CpuCount }}.
+type JobTemplateParams struct {
+	Name          string
+	CpuLimit      string
+	CpuRequest    string
+	CpuCount      int
+	LengthMinutes int
+	LengthSeconds int
+	NodeName      string
+}
+
+// JobTemplate is a named, parametrized batch/v1 Job manifest.
+type JobTemplate struct {
+	Name string
+	tmpl *template.Template
+}
+
+// NewJobTemplate parses the given manifest and makes sure that rendering it with sample parameters results in a
+// valid batch/v1 Job.
+func NewJobTemplate(name, manifest string) (*JobTemplate, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse job template %s: %w", name, err)
+	}
+	jobTemplate := &JobTemplate{Name: name, tmpl: tmpl}
+	_, err = jobTemplate.Render(JobTemplateParams{
+		Name:          "template-validation",
+		CpuLimit:      "1",
+		CpuRequest:    "250m",
+		CpuCount:      1,
+		LengthMinutes: 1,
+		LengthSeconds: 60,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobTemplate, nil
+}
+
+// Render substitutes the parameters into the template and decodes the result into a validated batch/v1 Job.
+func (t *JobTemplate) Render(params JobTemplateParams) (*v1batch.Job, error) {
+	var rendered bytes.Buffer
+	if err := t.tmpl.Execute(&rendered, params); err != nil {
+		return nil, fmt.Errorf("failed to render job template %s: %w", t.Name, err)
+	}
+	var job *v1batch.Job
+	err := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(rendered.Bytes()), rendered.Len()).Decode(&job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode job template %s: %w", t.Name, err)
+	}
+	if err = validateJob(job); err != nil {
+		return nil, fmt.Errorf("invalid job template %s: %w", t.Name, err)
+	}
+	return job, nil
+}
+
+func validateJob(job *v1batch.Job) error {
+	if job == nil {
+		return fmt.Errorf("template is empty")
+	}
+	if job.APIVersion != "batch/v1" || job.Kind != "Job" {
+		return fmt.Errorf("expected batch/v1 Job, got %s %s", job.APIVersion, job.Kind)
+	}
+	podSpec := job.Spec.Template.Spec
+	if len(podSpec.Containers) == 0 {
+		return fmt.Errorf("job must have at least one container")
+	}
+	for _, container := range podSpec.Containers {
+		if container.Name == "" || container.Image == "" {
+			return fmt.Errorf("every container must have a name and an image")
+		}
+	}
+	if podSpec.RestartPolicy != v1.RestartPolicyNever && podSpec.RestartPolicy != v1.RestartPolicyOnFailure {
+		return fmt.Errorf("restartPolicy must be Never or OnFailure, got %q", podSpec.RestartPolicy)
+	}
+	return nil
+}
+
+// JobTemplateRegistry holds the job templates that can be picked by name when spawning a workload.
+type JobTemplateRegistry struct {
+	mu        sync.RWMutex
+	templates map[string]*JobTemplate
+	logger    *zap.Logger
+}
+
+// NewJobTemplateRegistry creates a registry containing the built-in stress template.
+func NewJobTemplateRegistry(logger *zap.Logger) *JobTemplateRegistry {
+	r := &JobTemplateRegistry{
+		templates: make(map[string]*JobTemplate),
+		logger:    logger,
+	}
+	stress, err := NewJobTemplate(DefaultJobTemplate, StressJobPrototype)
+	if err != nil {
+		// The built-in template is a constant, failing here is a programming error
+		panic(err)
+	}
+	r.templates[DefaultJobTemplate] = stress
+	return r
+}
+
+// Register adds or replaces a template.
+func (r *JobTemplateRegistry) Register(name, manifest string) error {
+	jobTemplate, err := NewJobTemplate(name, manifest)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.templates[name]; exists {
+		r.logger.Info("overriding job template", zap.String("template", name))
+	}
+	r.templates[name] = jobTemplate
+	return nil
+}
+
+// Get returns the template with the given name. An empty name returns the default template.
+func (r *JobTemplateRegistry) Get(name string) (*JobTemplate, error) {
+	if name == "" {
+		name = DefaultJobTemplate
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	jobTemplate, ok := r.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("job template %s not found", name)
+	}
+	return jobTemplate, nil
+}
+
+// Names returns the sorted names of all registered templates.
+func (r *JobTemplateRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadDir registers every *.yaml / *.yml file in dir as a template named after the file (without extension).
+func (r *JobTemplateRegistry) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		manifest, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if err = r.Register(name, string(manifest)); err != nil {
+			return err
+		}
+		r.logger.Info("job template loaded from file", zap.String("template", name))
+	}
+	return nil
+}
+
+// LoadConfigMap registers every key of the given ConfigMap as a template named after the key (without extension).
+func (r *JobTemplateRegistry) LoadConfigMap(kc *Kubeclient, configMapName string) error {
+	cm, err := kc.CoreV1().ConfigMaps(kc.ns).Get(context.TODO(), configMapName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for key, manifest := range cm.Data {
+		name := strings.TrimSuffix(key, filepath.Ext(key))
+		if err = r.Register(name, manifest); err != nil {
+			return err
+		}
+		r.logger.Info("job template loaded from ConfigMap", zap.String("template", name),
+			zap.String("configMap", configMapName))
+	}
+	return nil
+}
+
+func newJobTemplateParams(name string, cpuLimit resource.Quantity, cpuCount int, length time.Duration,
+	nodeSelector map[string]string) JobTemplateParams {
+	return JobTemplateParams{
+		Name:          name,
+		CpuLimit:      cpuLimit.String(),
+		CpuRequest:    resource.NewMilliQuantity(cpuLimit.MilliValue()/4, resource.DecimalSI).String(),
+		CpuCount:      cpuCount,
+		LengthMinutes: int(length.Minutes()),
+		LengthSeconds: int(length.Seconds()),
+		NodeName:      nodeSelector["kubernetes.io/hostname"],
+	}
+}
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"github.com/gin-gonic/gin"
+	"net/http"
 )
 
 // from https://stackoverflow.com/questions/29418478/go-gin-framework-cors
@@ -18,3 +19,21 @@ func CorsDisabled(c *gin.Context) {
 
 	c.Next()
 }
+
+// ReadOnlyUnless rejects the requests that are not GET, HEAD or OPTIONS with 503 Service Unavailable when allowWrites
+// returns false, e.g. on replicas that are not the leader.
+func ReadOnlyUnless(allowWrites func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !allowWrites() {
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+					"error": "this replica is not the leader, only read requests are served",
+				})
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -170,7 +170,11 @@ func (p *Promclient) GetNodeCpuDiff(nodeName string) (float64, error) {
 	if len(warnings) > 0 {
 		p.logger.Warn(fmt.Sprintf("Prometheus Warnings: %v\n", warnings))
 	}
-	return strconv.ParseFloat(result.(model.Vector)[0].Value.String(), 64)
+	vector := result.(model.Vector)
+	if len(vector) == 0 {
+		return 0, fmt.Errorf("no %s sample for node %q", cpuDiffMetricName, nodeName)
+	}
+	return strconv.ParseFloat(vector[0].Value.String(), 64)
 }
 
 func (p *Promclient) GetCurrentEnergyConsumption() (map[string]float64, error) {
@@ -251,3 +255,27 @@ func GetAvgInstantUsage(usages []InstantCpuUsage) float64 {
 	}
 	return sum / float64(len(usages))
 }
+
+// GetValuesByLabel runs an instant query and returns its values keyed by the given label, e.g. temperatures keyed by
+// node name. If several series share the same label value, the highest value is kept.
+func (p *Promclient) GetValuesByLabel(query string, label string) (map[string]float64, error) {
+	result, warnings, err := p.Query(ctx.Background(), query, time.Now(), v1.WithTimeout(5*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if len(warnings) > 0 {
+		p.logger.Warn(fmt.Sprintf("Prometheus Warnings: %v\n", warnings))
+	}
+	values := make(map[string]float64)
+	for _, entry := range result.(model.Vector) {
+		value, err := strconv.ParseFloat(entry.Value.String(), 64)
+		if err != nil {
+			return nil, err
+		}
+		key := string(model.LabelSet(entry.Metric)[model.LabelName(label)])
+		if current, ok := values[key]; !ok || value > current {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
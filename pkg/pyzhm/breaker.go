@@ -0,0 +1,107 @@
+package pyzhm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("pyzhm circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker opens after failureThreshold consecutive failures and rejects requests for openTimeout, after which a
+// single trial request is let through (half-open): its success closes the breaker, its failure opens it again.
+type circuitBreaker struct {
+	mu               sync.Mutex
+	state            breakerState
+	failures         int
+	failureThreshold int
+	openTimeout      time.Duration
+	openedAt         time.Time
+	onStateChange    func(open bool)
+}
+
+func newCircuitBreaker(failureThreshold int, openTimeout time.Duration, onStateChange func(open bool)) *circuitBreaker {
+	return &circuitBreaker{
+		state:            breakerClosed,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		onStateChange:    onStateChange,
+	}
+}
+
+// admits returns whether a request would be let through right now, b.mu must be held. Both allow and isOpen are
+// derived from it so that they agree in every state.
+func (b *circuitBreaker) admits() bool {
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.openTimeout
+	case breakerHalfOpen:
+		// A trial request is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// allow returns whether a request can be sent. Once the open timeout has elapsed the request is the trial request.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.admits() {
+		return false
+	}
+	if b.state == breakerOpen {
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+// isOpen returns whether requests are currently being rejected.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.admits()
+}
+
+// abort releases the trial request without an outcome, e.g. when the caller gave up on it, so that the next request
+// becomes the trial request instead of the breaker staying half-open.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.state != breakerClosed
+	b.state = breakerClosed
+	b.failures = 0
+	if wasOpen {
+		b.onStateChange(false)
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.failureThreshold {
+		wasClosed := b.state == breakerClosed
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		if wasClosed {
+			b.onStateChange(true)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package pyzhm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var changes []bool
+	b := newCircuitBreaker(2, 20*time.Millisecond, func(open bool) {
+		changes = append(changes, open)
+	})
+
+	b.failure()
+	if !b.allow() || b.isOpen() {
+		t.Fatal("breaker rejects requests below the failure threshold")
+	}
+	b.failure()
+	if b.allow() || !b.isOpen() {
+		t.Fatal("breaker lets requests through after reaching the failure threshold")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if b.isOpen() {
+		t.Fatal("breaker reports open although the trial request would be let through")
+	}
+	if !b.allow() {
+		t.Fatal("breaker rejects the trial request after the open timeout")
+	}
+	// Half-open: the trial request is in flight
+	if b.allow() || !b.isOpen() {
+		t.Fatal("breaker lets a second request through while half-open")
+	}
+
+	// The trial request failing opens the breaker again
+	b.failure()
+	if b.allow() || !b.isOpen() {
+		t.Fatal("breaker not open after the trial request failed")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker rejects the trial request after the open timeout")
+	}
+	b.success()
+	if !b.allow() || b.isOpen() {
+		t.Fatal("breaker not closed after the trial request succeeded")
+	}
+
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Fatalf("state changes = %v, want [true false]", changes)
+	}
+}
+
+func TestCircuitBreakerAbort(t *testing.T) {
+	b := newCircuitBreaker(1, 10*time.Millisecond, func(bool) {})
+	b.failure()
+	time.Sleep(10 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker rejects the trial request after the open timeout")
+	}
+	b.abort()
+	// The aborted trial request does not restart the open timeout, the next request is the trial request
+	if !b.allow() {
+		t.Fatal("breaker stuck half-open after the trial request was aborted")
+	}
+	if b.allow() {
+		t.Fatal("breaker lets a second request through while half-open")
+	}
+
+	// Aborting outside of half-open changes nothing
+	b.success()
+	b.abort()
+	if !b.allow() || b.isOpen() {
+		t.Fatal("abort changed a closed breaker")
+	}
+}
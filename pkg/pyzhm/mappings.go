@@ -0,0 +1,77 @@
+package pyzhm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NodeMappings maps the rack slot labels used by pyzhm (e.g. "L1", "R23") to Kubernetes node names and back.
+type NodeMappings struct {
+	labelToNode map[string]string
+	nodeToLabel map[string]string
+}
+
+// NewNodeMappings builds the mappings from the label -> node name map of the config, making sure that no label or
+// node name is empty and that each node is mapped to a single label.
+func NewNodeMappings(labelToNode map[string]string) (*NodeMappings, error) {
+	m := &NodeMappings{
+		labelToNode: make(map[string]string),
+		nodeToLabel: make(map[string]string),
+	}
+	for label, nodeName := range labelToNode {
+		if label == "" || nodeName == "" {
+			return nil, fmt.Errorf("invalid pyzhm node mapping %q -> %q", label, nodeName)
+		}
+		if other, exists := m.nodeToLabel[nodeName]; exists {
+			return nil, fmt.Errorf("node %s is mapped to both pyzhm labels %s and %s", nodeName, other, label)
+		}
+		m.labelToNode[label] = nodeName
+		m.nodeToLabel[nodeName] = label
+	}
+	return m, nil
+}
+
+// NodeName returns the Kubernetes node name of a pyzhm label.
+func (m *NodeMappings) NodeName(label string) (string, error) {
+	nodeName, ok := m.labelToNode[label]
+	if !ok {
+		return "", fmt.Errorf("pyzhm label %q is not mapped to any node, check pyzhmNodeMappings", label)
+	}
+	return nodeName, nil
+}
+
+// Label returns the pyzhm label of a Kubernetes node name.
+func (m *NodeMappings) Label(nodeName string) (string, error) {
+	label, ok := m.nodeToLabel[nodeName]
+	if !ok {
+		return "", fmt.Errorf("node %q is not mapped to any pyzhm label, check pyzhmNodeMappings", nodeName)
+	}
+	return label, nil
+}
+
+// NodeNames returns the sorted names of the mapped nodes.
+func (m *NodeMappings) NodeNames() []string {
+	names := make([]string, 0, len(m.nodeToLabel))
+	for nodeName := range m.nodeToLabel {
+		names = append(names, nodeName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ByLabel converts values keyed by node name into values keyed by pyzhm label, e.g. to build a Scenario from
+// per-node metrics. Unmapped nodes are dropped.
+func (m *NodeMappings) ByLabel(byNode map[string]float64) map[string]float64 {
+	byLabel := make(map[string]float64)
+	for nodeName, v := range byNode {
+		if label, ok := m.nodeToLabel[nodeName]; ok {
+			byLabel[label] = v
+		}
+	}
+	return byLabel
+}
+
+// Len returns the number of mapped nodes.
+func (m *NodeMappings) Len() int {
+	return len(m.labelToNode)
+}
@@ -0,0 +1,152 @@
+package pyzhm
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"sort"
+)
+
+const (
+	PyzhmPlacerName  = "pyzhm"
+	GreedyPlacerName = "greedy"
+)
+
+// Placer predicts on which node label each job of a scenario should run.
+type Placer interface {
+	Predict(scenario Scenario) (Predictions, error)
+}
+
+// Availability is implemented by placers that can tell whether they are currently able to serve predictions.
+type Availability interface {
+	Available() bool
+}
+
+// IsAvailable returns whether the placer can currently serve predictions, placers not implementing Availability are
+// always available.
+func IsAvailable(placer Placer) bool {
+	if a, ok := placer.(Availability); ok {
+		return a.Available()
+	}
+	return true
+}
+
+// ContextPlacer is implemented by placers whose predictions can be cancelled through a context.
+type ContextPlacer interface {
+	PredictContext(ctx context.Context, scenario Scenario) (Predictions, error)
+}
+
+// Predict asks the placer for predictions, cancelled with ctx if the placer implements ContextPlacer.
+func Predict(ctx context.Context, placer Placer, scenario Scenario) (Predictions, error) {
+	if c, ok := placer.(ContextPlacer); ok {
+		return c.PredictContext(ctx, scenario)
+	}
+	return placer.Predict(scenario)
+}
+
+// CapacityFunc returns the number of free cores per node label.
+type CapacityFunc func() (map[string]float64, error)
+
+// GreedyPlacer is an in-process Placer doing energy-aware best-fit-decreasing bin packing: the biggest jobs are placed
+// first, each on the node whose free cores fit the job most tightly, so that load is consolidated on few nodes and the
+// others can idle. Ties are broken in favour of the node currently drawing less power.
+type GreedyPlacer struct {
+	capacity CapacityFunc
+	logger   *zap.Logger
+}
+
+func NewGreedyPlacer(capacity CapacityFunc, logger *zap.Logger) *GreedyPlacer {
+	return &GreedyPlacer{capacity: capacity, logger: logger.With(zap.String("placer", GreedyPlacerName))}
+}
+
+func (g *GreedyPlacer) Predict(scenario Scenario) (Predictions, error) {
+	if len(scenario.Scenario) == 0 {
+		return Predictions{}, fmt.Errorf("scenario has no nodes")
+	}
+	freeCores, err := g.capacity()
+	if err != nil {
+		g.logger.Error("failed to get node capacity", zap.Error(err))
+		return Predictions{}, err
+	}
+	free := make(map[string]float64)
+	for label := range scenario.Scenario {
+		free[label] = freeCores[label]
+	}
+
+	jobNames := scenario.JobNames()
+	sort.Slice(jobNames, func(i, j int) bool {
+		if scenario.Requirements[jobNames[i]] != scenario.Requirements[jobNames[j]] {
+			return scenario.Requirements[jobNames[i]] > scenario.Requirements[jobNames[j]]
+		}
+		return jobNames[i] < jobNames[j]
+	})
+	labels := make([]string, 0, len(scenario.Scenario))
+	for label := range scenario.Scenario {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	predictions := Predictions{Assignments: make(map[string]string), Placer: GreedyPlacerName}
+	for _, jobName := range jobNames {
+		cores := scenario.Requirements[jobName]
+		best := ""
+		for _, label := range labels {
+			if free[label] < cores {
+				continue
+			}
+			if best == "" || free[label] < free[best] ||
+				(free[label] == free[best] && scenario.Scenario[label] < scenario.Scenario[best]) {
+				best = label
+			}
+		}
+		// Nothing fits, fall back to the node with the most room left
+		if best == "" {
+			for _, label := range labels {
+				if best == "" || free[label] > free[best] {
+					best = label
+				}
+			}
+		}
+		free[best] -= cores
+		predictions.Assignments[jobName] = best
+		g.logger.Debug("job placed", zap.String("job", jobName), zap.Float64("cores", cores), zap.String("label", best))
+	}
+	return predictions, nil
+}
+
+// FallbackPlacer predicts with the primary placer and, if it fails, with the fallback one.
+type FallbackPlacer struct {
+	primary  Placer
+	fallback Placer
+	logger   *zap.Logger
+}
+
+func NewFallbackPlacer(primary Placer, fallback Placer, logger *zap.Logger) *FallbackPlacer {
+	return &FallbackPlacer{primary: primary, fallback: fallback, logger: logger}
+}
+
+func (f *FallbackPlacer) Predict(scenario Scenario) (Predictions, error) {
+	return f.PredictContext(context.Background(), scenario)
+}
+
+// PredictContext uses the fallback placer when the primary one fails, unless ctx is done.
+func (f *FallbackPlacer) PredictContext(ctx context.Context, scenario Scenario) (Predictions, error) {
+	predictions, err := Predict(ctx, f.primary, scenario)
+	if err == nil {
+		return predictions, nil
+	}
+	if ctx.Err() != nil {
+		return Predictions{}, err
+	}
+	f.logger.Warn("primary placer failed, using fallback placer", zap.Error(err))
+	predictions, fallbackErr := Predict(ctx, f.fallback, scenario)
+	if fallbackErr != nil {
+		return Predictions{}, fallbackErr
+	}
+	predictions.FallbackReason = err.Error()
+	return predictions, nil
+}
+
+func (f *FallbackPlacer) Available() bool {
+	return IsAvailable(f.primary) || IsAvailable(f.fallback)
+}
@@ -2,11 +2,16 @@ package pyzhm
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 	"io"
 	"k8s.io/apimachinery/pkg/util/json"
 	"net/http"
+	"time"
 )
 
 const TestScenarioJson = `
@@ -43,56 +48,333 @@ const TestScenarioJson = `
 }
 `
 
+const (
+	DefaultTimeout          = 10 * time.Second
+	DefaultRetries          = 2
+	DefaultRetryBackoff     = 500 * time.Millisecond
+	DefaultFailureThreshold = 3
+	DefaultOpenTimeout      = 30 * time.Second
+	DefaultHealthPath       = "/"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "pyzhm_request_duration_seconds",
+		Help: "Latency of pyzhm prediction requests.",
+	}, []string{"result"})
+	requestFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyzhm_request_failures_total",
+		Help: "Failed pyzhm prediction requests by reason.",
+	}, []string{"reason"})
+	circuitOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pyzhm_circuit_open",
+		Help: "1 if the pyzhm circuit breaker is open, i.e. TAWA placement through pyzhm is disabled.",
+	})
+)
+
+// requestError is a failed pyzhm request, retryable if pyzhm could not be reached or answered with a server error.
+type requestError struct {
+	reason    string
+	retryable bool
+	err       error
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("pyzhm request failed (%s): %v", e.reason, e.err)
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
 type PyzhmClient struct {
-	logger  *zap.Logger
-	address string
+	logger     *zap.Logger
+	address    string
+	httpClient *http.Client
+
+	timeout          time.Duration
+	retries          int
+	retryBackoff     time.Duration
+	failureThreshold int
+	openTimeout      time.Duration
+	healthPath       string
+
+	breaker *circuitBreaker
+}
+
+type PyzhmClientOption func(*PyzhmClient)
+
+// Timeout sets the timeout of a single request to pyzhm.
+func Timeout(timeout time.Duration) PyzhmClientOption {
+	return func(p *PyzhmClient) {
+		p.timeout = timeout
+	}
+}
+
+// Retries sets how many times a failed request is retried, with exponential backoff starting at retryBackoff.
+func Retries(retries int, retryBackoff time.Duration) PyzhmClientOption {
+	return func(p *PyzhmClient) {
+		p.retries = retries
+		p.retryBackoff = retryBackoff
+	}
+}
+
+// CircuitBreaker sets after how many consecutive failures pyzhm is considered down, and for how long.
+func CircuitBreaker(failureThreshold int, openTimeout time.Duration) PyzhmClientOption {
+	return func(p *PyzhmClient) {
+		p.failureThreshold = failureThreshold
+		p.openTimeout = openTimeout
+	}
+}
+
+// HealthPath sets the path probed to check whether pyzhm is back up.
+func HealthPath(path string) PyzhmClientOption {
+	return func(p *PyzhmClient) {
+		p.healthPath = path
+	}
+}
+
+func NewPyzhmClient(logger *zap.Logger, pyzhmAddress string, options ...PyzhmClientOption) *PyzhmClient {
+	p := &PyzhmClient{
+		logger:           logger,
+		address:          pyzhmAddress,
+		httpClient:       &http.Client{},
+		timeout:          DefaultTimeout,
+		retries:          DefaultRetries,
+		retryBackoff:     DefaultRetryBackoff,
+		failureThreshold: DefaultFailureThreshold,
+		openTimeout:      DefaultOpenTimeout,
+		healthPath:       DefaultHealthPath,
+	}
+	for _, setter := range options {
+		setter(p)
+	}
+	p.breaker = newCircuitBreaker(p.failureThreshold, p.openTimeout, func(open bool) {
+		if open {
+			p.logger.Warn("pyzhm is down, opening circuit breaker", zap.Duration("openTimeout", p.openTimeout))
+			circuitOpen.Set(1)
+		} else {
+			p.logger.Info("pyzhm is back up, closing circuit breaker")
+			circuitOpen.Set(0)
+		}
+	})
+	return p
 }
 
 type Scenario struct {
 	// NodeLabel -> InstantPowerUsage
-	Scenario     map[string]float64 `json:"scenario"`
+	Scenario map[string]float64 `json:"scenario"`
+	// JobName -> Cores
 	Requirements map[string]float64 `json:"requirements"`
 }
 
+// NewScenario creates a scenario with the given power usage per node label and no jobs.
+func NewScenario(power map[string]float64) Scenario {
+	scenario := Scenario{
+		Scenario:     make(map[string]float64),
+		Requirements: make(map[string]float64),
+	}
+	for k, v := range power {
+		scenario.Scenario[k] = v
+	}
+	return scenario
+}
+
+// AddJob adds the core requirements of a job to the scenario, the job name is the key of its assignment.
+func (s *Scenario) AddJob(jobName string, cores float64) error {
+	if _, exists := s.Requirements[jobName]; exists {
+		return fmt.Errorf("job %s is already part of the scenario", jobName)
+	}
+	s.Requirements[jobName] = cores
+	return nil
+}
+
+// JobNames returns the names of the jobs in the scenario.
+func (s *Scenario) JobNames() []string {
+	names := make([]string, 0, len(s.Requirements))
+	for name := range s.Requirements {
+		names = append(names, name)
+	}
+	return names
+}
+
 type Predictions struct {
+	// JobName -> NodeLabel
 	Assignments map[string]string `json:"assignments"`
+	// Placer is the name of the placer that made the predictions
+	Placer string `json:"-"`
+	// FallbackReason is why the primary placer was not used, if a fallback placer made the predictions
+	FallbackReason string `json:"-"`
 }
 
-func NewPyzhmClient(logger *zap.Logger, pyzhmAddress string) *PyzhmClient {
-	return &PyzhmClient{logger, pyzhmAddress}
+// NodeLabel returns the node label the job was assigned to.
+func (p Predictions) NodeLabel(jobName string) (string, error) {
+	label, ok := p.Assignments[jobName]
+	if !ok || label == "" {
+		return "", fmt.Errorf("no assignment for job %s", jobName)
+	}
+	return label, nil
 }
 
+// Predict sends the scenario with all its jobs to pyzhm in a single request, so that the jobs are co-optimized,
+// and returns an assignment for each of them.
 func (p *PyzhmClient) Predict(scenario Scenario) (Predictions, error) {
+	return p.PredictContext(context.Background(), scenario)
+}
+
+// PredictContext is Predict with a parent context. Each attempt is bounded by the client timeout, failed attempts are
+// retried with exponential backoff and ErrCircuitOpen is returned right away while pyzhm is considered down.
+func (p *PyzhmClient) PredictContext(ctx context.Context, scenario Scenario) (Predictions, error) {
+	if !p.breaker.allow() {
+		requestFailures.WithLabelValues("circuit_open").Inc()
+		return Predictions{}, ErrCircuitOpen
+	}
 	// Marshal scenario into JSON and send post request to pyzhm
 	payload, err := json.Marshal(scenario)
 	if err != nil {
 		p.logger.Error("failed to marshal scenario", zap.Error(err))
 		return Predictions{}, err
 	}
-	payloadReader := bytes.NewReader(payload)
-	resp, err := http.Post(p.address+"/predict", "application/json", payloadReader)
 
+	backoff := p.retryBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		predictions, err := p.predict(ctx, payload, scenario)
+		if err == nil {
+			requestDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+			p.breaker.success()
+			return predictions, nil
+		}
+		requestDuration.WithLabelValues("failure").Observe(time.Since(start).Seconds())
+		var reqErr *requestError
+		retryable := false
+		if errors.As(err, &reqErr) {
+			requestFailures.WithLabelValues(reqErr.reason).Inc()
+			retryable = reqErr.retryable
+		}
+		p.logger.Error("pyzhm prediction failed", zap.Error(err), zap.Int("attempt", attempt+1))
+		// The caller giving up says nothing about the health of pyzhm
+		if ctx.Err() != nil {
+			p.breaker.abort()
+			return Predictions{}, ctx.Err()
+		}
+		if !retryable || attempt >= p.retries {
+			p.breaker.failure()
+			return Predictions{}, err
+		}
+		select {
+		case <-ctx.Done():
+			p.breaker.abort()
+			return Predictions{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (p *PyzhmClient) predict(ctx context.Context, payload []byte, scenario Scenario) (Predictions, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.address+"/predict", bytes.NewReader(payload))
 	if err != nil {
-		p.logger.Error("failed to send post request to pyzhm", zap.Error(err))
 		return Predictions{}, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return Predictions{}, &requestError{reason: "transport", retryable: true, err: err}
+	}
 	defer resp.Body.Close()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		p.logger.Error("failed to read response body from pyzhm", zap.Error(err))
-		return Predictions{}, err
+		return Predictions{}, &requestError{reason: "transport", retryable: true, err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Predictions{}, &requestError{
+			reason:    "status",
+			retryable: resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			err:       fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(respBody)),
+		}
 	}
 	// Unmarshal response into Predictions
 	var predictions Predictions
 	err = json.Unmarshal(respBody, &predictions)
 	if err != nil {
-		p.logger.Error("failed to unmarshal response body from pyzhm", zap.Error(err))
-		return Predictions{}, err
+		return Predictions{}, &requestError{reason: "decode", err: err}
 	}
-
+	if err = validatePredictions(scenario, predictions); err != nil {
+		return Predictions{}, &requestError{reason: "schema", err: err}
+	}
+	predictions.Placer = PyzhmPlacerName
 	return predictions, nil
 }
 
+// validatePredictions makes sure every job of the batch is assigned to a node label of the scenario, otherwise the
+// batch cannot be applied as a whole.
+func validatePredictions(scenario Scenario, predictions Predictions) error {
+	if predictions.Assignments == nil {
+		return fmt.Errorf("response has no assignments")
+	}
+	for jobName := range scenario.Requirements {
+		label, err := predictions.NodeLabel(jobName)
+		if err != nil {
+			return err
+		}
+		if _, ok := scenario.Scenario[label]; !ok {
+			return fmt.Errorf("job %s assigned to unknown node label %s", jobName, label)
+		}
+	}
+	return nil
+}
+
+// Available returns false while the circuit breaker rejects requests, i.e. while pyzhm is considered down or a trial
+// request is in flight.
+func (p *PyzhmClient) Available() bool {
+	return !p.breaker.isOpen()
+}
+
+// StartHealthProbe probes pyzhm every interval until ctx is done. While the breaker is open a successful probe closes
+// it, so that placement through pyzhm resumes without waiting for a trial request.
+func (p *PyzhmClient) StartHealthProbe(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if p.Available() {
+					continue
+				}
+				if err := p.probe(ctx); err != nil {
+					p.logger.Debug("pyzhm health probe failed", zap.Error(err))
+					continue
+				}
+				p.breaker.success()
+			}
+		}
+	}()
+}
+
+func (p *PyzhmClient) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.address+p.healthPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (p *PyzhmClient) GetTestScenario() (Scenario, error) {
 	// Unmarshal test scenario into Scenario
 	scenario := Scenario{}
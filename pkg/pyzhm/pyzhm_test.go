@@ -0,0 +1,178 @@
+package pyzhm
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testScenario() Scenario {
+	scenario := NewScenario(map[string]float64{"L1": 100, "L3": 120})
+	_ = scenario.AddJob("job1", 1)
+	return scenario
+}
+
+// testServer answers /predict with the given status codes in turn, repeating the last one, and a valid assignment of
+// job1 on success.
+func testServer(t *testing.T, requests *atomic.Int64, statuses ...int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		if n >= len(statuses) {
+			n = len(statuses) - 1
+		}
+		w.WriteHeader(statuses[n])
+		if statuses[n] == http.StatusOK {
+			_, _ = w.Write([]byte(`{"assignments": {"job1": "L3"}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPredictRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		requests int64
+	}{
+		{"success", []int{http.StatusOK}, false, 1},
+		{"retried server error", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, false, 3},
+		{"retried too many requests", []int{http.StatusTooManyRequests, http.StatusOK}, false, 2},
+		{"retries exhausted", []int{http.StatusServiceUnavailable}, true, 3},
+		{"client error not retried", []int{http.StatusBadRequest, http.StatusOK}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			server := testServer(t, &requests, tt.statuses...)
+			client := NewPyzhmClient(zap.NewNop(), server.URL, Retries(2, time.Millisecond))
+
+			predictions, err := client.Predict(testScenario())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Fatalf("requests = %d, want %d", got, tt.requests)
+			}
+			if !tt.wantErr && (predictions.Assignments["job1"] != "L3" || predictions.Placer != PyzhmPlacerName) {
+				t.Fatalf("predictions = %+v, want job1 on L3 by %s", predictions, PyzhmPlacerName)
+			}
+		})
+	}
+}
+
+func TestPredictCircuitBreaker(t *testing.T) {
+	var requests atomic.Int64
+	server := testServer(t, &requests, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK)
+	client := NewPyzhmClient(zap.NewNop(), server.URL, CircuitBreaker(2, 20*time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Predict(testScenario()); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("request %d: err = %v, want the status error", i, err)
+		}
+	}
+	if client.Available() {
+		t.Fatal("client available after reaching the failure threshold")
+	}
+	if _, err := client.Predict(testScenario()); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if requests.Load() != 2 {
+		t.Fatalf("requests = %d, want 2, the open breaker must not send requests", requests.Load())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !client.Available() {
+		t.Fatal("client unavailable after the open timeout")
+	}
+	if _, err := client.Predict(testScenario()); err != nil {
+		t.Fatalf("trial request failed: %v", err)
+	}
+	if !client.Available() {
+		t.Fatal("client unavailable after the trial request succeeded")
+	}
+}
+
+func TestPredictCancelledIsNoFailure(t *testing.T) {
+	var requests atomic.Int64
+	server := testServer(t, &requests, http.StatusServiceUnavailable)
+	client := NewPyzhmClient(zap.NewNop(), server.URL, Retries(5, time.Hour), CircuitBreaker(1, time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for requests.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	// The first attempt fails and the cancellation ends the backoff
+	if _, err := client.PredictContext(ctx, testScenario()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if !client.Available() {
+		t.Fatal("cancelled request counted as a breaker failure")
+	}
+
+	// Already cancelled before the request
+	if _, err := client.PredictContext(ctx, testScenario()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if !client.Available() {
+		t.Fatal("cancelled request counted as a breaker failure")
+	}
+}
+
+func TestPredictCancelledTrialRequest(t *testing.T) {
+	var requests atomic.Int64
+	server := testServer(t, &requests, http.StatusBadRequest, http.StatusOK)
+	client := NewPyzhmClient(zap.NewNop(), server.URL, CircuitBreaker(1, 10*time.Millisecond))
+
+	if _, err := client.Predict(testScenario()); err == nil {
+		t.Fatal("first request succeeded, want the status error")
+	}
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.PredictContext(ctx, testScenario()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	// The cancelled trial request must not leave the breaker half-open
+	if _, err := client.Predict(testScenario()); err != nil {
+		t.Fatalf("trial request after the cancelled one failed: %v", err)
+	}
+	if !client.Available() {
+		t.Fatal("client unavailable after the trial request succeeded")
+	}
+}
+
+func TestValidatePredictions(t *testing.T) {
+	scenario := NewScenario(map[string]float64{"L1": 100, "L3": 120})
+	_ = scenario.AddJob("job1", 1)
+	_ = scenario.AddJob("job2", 2)
+	tests := []struct {
+		name        string
+		assignments map[string]string
+		wantErr     bool
+	}{
+		{"all jobs assigned", map[string]string{"job1": "L1", "job2": "L3"}, false},
+		{"extra assignment ignored", map[string]string{"job1": "L1", "job2": "L3", "job3": "L1"}, false},
+		{"no assignments", nil, true},
+		{"job missing", map[string]string{"job1": "L1"}, true},
+		{"empty node label", map[string]string{"job1": "L1", "job2": ""}, true},
+		{"unknown node label", map[string]string{"job1": "L1", "job2": "L5"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePredictions(scenario, Predictions{Assignments: tt.assignments})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
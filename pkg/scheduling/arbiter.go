@@ -0,0 +1,158 @@
+package scheduling
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Resource is a piece of cluster or exporter state that strategies mutate.
+type Resource string
+
+const (
+	ResourceTargets     Resource = "targets"     // the exported Target of the nodes
+	ResourceSchedulable Resource = "schedulable" // the exported Schedulable gauge of the nodes
+	ResourcePodLimits   Resource = "podLimits"   // the CPU limits of the pods
+	ResourceNodePower   Resource = "nodePower"   // servers powered on and off, with their node cordoned and drained
+)
+
+// DefaultMutationWindow is how long a strategy keeps a resource of a node after mutating it, other strategies cannot
+// mutate the same resource of the node meanwhile.
+const DefaultMutationWindow = 10 * time.Second
+
+type ConflictPolicy string
+
+const (
+	// ConflictWarn logs a warning when starting a strategy conflicting with a running one
+	ConflictWarn ConflictPolicy = "warn"
+	// ConflictReject refuses to start a strategy conflicting with a running one
+	ConflictReject ConflictPolicy = "reject"
+)
+
+var strategyConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "target_exporter_strategy_conflicts_total",
+	Help: "Mutations of a node resource denied to a strategy because another strategy mutated it in the same window.",
+}, []string{"strategy", "resource"})
+
+// compatibleStrategies are pairs of strategies mutating the same resources by design, e.g. the server on/off strategy
+// cordons the nodes it powers off so that the schedulable strategy keeps them unschedulable.
+var compatibleStrategies = map[[2]string]bool{
+	{"schedulable", "serverOnOff"}: true,
+}
+
+// Mutates declares the resources a strategy mutates, strategies sharing a resource conflict unless they are known to
+// be compatible.
+func Mutates(resources ...Resource) StrategyOption {
+	return func(c *BaseConcurrentStrategy) {
+		c.resources = resources
+	}
+}
+
+// Conflict is a pair of strategies mutating the same resource.
+type Conflict struct {
+	Strategy string   `json:"strategy"`
+	Other    string   `json:"other"`
+	Resource Resource `json:"resource"`
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("strategies %s and %s both mutate %s", c.Strategy, c.Other, c.Resource)
+}
+
+// Conflicts returns the resources both strategies mutate, none if they are known to be compatible.
+func Conflicts(strategy, other Strategy) []Conflict {
+	if strategy.Name() == other.Name() || compatibleStrategies[[2]string{strategy.Name(), other.Name()}] ||
+		compatibleStrategies[[2]string{other.Name(), strategy.Name()}] {
+		return nil
+	}
+	conflicts := make([]Conflict, 0)
+	for _, resource := range strategy.Resources() {
+		for _, otherResource := range other.Resources() {
+			if resource == otherResource {
+				conflicts = append(conflicts, Conflict{Strategy: strategy.Name(), Other: other.Name(), Resource: resource})
+			}
+		}
+	}
+	return conflicts
+}
+
+type mutation struct {
+	strategy string
+	time     time.Time
+	// ongoing mutations, e.g. a server being powered off, keep the resource until they end
+	ongoing bool
+}
+
+// Arbiter serializes the mutations of the nodes: a single strategy mutates a node at a time, and once a strategy
+// mutated a resource of a node, other strategies cannot mutate it until the mutation window is over.
+type Arbiter struct {
+	window time.Duration
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	nodeLocks map[string]*sync.Mutex
+	mutations map[string]map[Resource]mutation
+}
+
+func NewArbiter(window time.Duration, logger *zap.Logger) *Arbiter {
+	if window <= 0 {
+		window = DefaultMutationWindow
+	}
+	return &Arbiter{
+		window:    window,
+		logger:    logger.With(zap.String("component", "arbiter")),
+		nodeLocks: make(map[string]*sync.Mutex),
+		mutations: make(map[string]map[Resource]mutation),
+	}
+}
+
+// Acquire locks the node for the strategy to mutate the resource. It returns false if another strategy mutated the
+// resource of the node within the mutation window, otherwise the node must be released once mutated.
+func (a *Arbiter) Acquire(strategy, nodeName string, resource Resource) (release func(), ok bool) {
+	a.mu.Lock()
+	nodeLock, found := a.nodeLocks[nodeName]
+	if !found {
+		nodeLock = &sync.Mutex{}
+		a.nodeLocks[nodeName] = nodeLock
+	}
+	a.mu.Unlock()
+
+	nodeLock.Lock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last, found := a.mutations[nodeName][resource]
+	if found && last.strategy != strategy && (last.ongoing || time.Since(last.time) < a.window) {
+		nodeLock.Unlock()
+		strategyConflicts.WithLabelValues(strategy, string(resource)).Inc()
+		a.logger.Warn("mutation denied, node resource recently mutated by another strategy",
+			zap.String("strategy", strategy), zap.String("nodeName", nodeName), zap.String("resource", string(resource)),
+			zap.String("mutatedBy", last.strategy))
+		return nil, false
+	}
+	if a.mutations[nodeName] == nil {
+		a.mutations[nodeName] = make(map[Resource]mutation)
+	}
+	a.mutations[nodeName][resource] = mutation{strategy: strategy, time: time.Now(), ongoing: found && last.ongoing}
+	return nodeLock.Unlock, true
+}
+
+// Begin starts a long mutation of the resource of the node, e.g. powering a server off, which other strategies cannot
+// mutate until end is called, the mutation window starting then. Unlike Acquire, the node is not kept locked.
+func (a *Arbiter) Begin(strategy, nodeName string, resource Resource) (end func(), ok bool) {
+	release, ok := a.Acquire(strategy, nodeName, resource)
+	if !ok {
+		return nil, false
+	}
+	defer release()
+	a.mu.Lock()
+	a.mutations[nodeName][resource] = mutation{strategy: strategy, time: time.Now(), ongoing: true}
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.mutations[nodeName][resource] = mutation{strategy: strategy, time: time.Now()}
+	}, true
+}
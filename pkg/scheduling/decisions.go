@@ -0,0 +1,122 @@
+package scheduling
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultDecisionLogSize is how many placement decisions are kept in memory if not configured otherwise.
+const DefaultDecisionLogSize = 500
+
+type PlacementOutcome string
+
+const (
+	PlacementPlaced   PlacementOutcome = "placed"   // spawned on the predicted node
+	PlacementDeferred PlacementOutcome = "deferred" // kept queued, e.g. because the predicted node had no room
+	PlacementRejected PlacementOutcome = "rejected" // removed from the queue, e.g. because spawning failed
+	PlacementFailed   PlacementOutcome = "failed"   // no prediction could be obtained
+)
+
+// PlacementDecision records how a single workload was placed: what was sent to the placer, what it answered and
+// what was eventually done with it.
+type PlacementDecision struct {
+	Time           time.Time          `json:"time"`
+	WorkloadId     string             `json:"workloadId"`
+	BatchId        string             `json:"batchId,omitempty"`
+	JobName        string             `json:"jobName"`
+	Placer         string             `json:"placer,omitempty"`
+	FallbackReason string             `json:"fallbackReason,omitempty"`
+	Scenario       map[string]float64 `json:"scenario"`
+	Requirements   map[string]float64 `json:"requirements"`
+	PredictedLabel string             `json:"predictedLabel,omitempty"`
+	PredictedNode  string             `json:"predictedNode,omitempty"`
+	NodeCpuDiff    *float64           `json:"nodeCpuDiff,omitempty"`
+	NodeName       string             `json:"nodeName,omitempty"`
+	Outcome        PlacementOutcome   `json:"outcome"`
+	Reason         string             `json:"reason,omitempty"`
+}
+
+// DecisionLog keeps the last placement decisions in memory and, optionally, appends every decision to a JSONL file.
+type DecisionLog struct {
+	mu        sync.Mutex
+	decisions []PlacementDecision
+	next      int
+	full      bool
+	file      *os.File
+	encoder   *json.Encoder
+	logger    *zap.Logger
+}
+
+// NewDecisionLog creates a log holding up to size decisions. If path is not empty, decisions are also appended to it.
+func NewDecisionLog(size int, path string, logger *zap.Logger) (*DecisionLog, error) {
+	if size <= 0 {
+		size = DefaultDecisionLogSize
+	}
+	d := &DecisionLog{
+		decisions: make([]PlacementDecision, size),
+		logger:    logger,
+	}
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		d.file = file
+		d.encoder = json.NewEncoder(file)
+	}
+	return d, nil
+}
+
+// Record adds a decision to the log.
+func (d *DecisionLog) Record(decision PlacementDecision) {
+	if decision.Time.IsZero() {
+		decision.Time = time.Now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.decisions[d.next] = decision
+	d.next = (d.next + 1) % len(d.decisions)
+	if d.next == 0 {
+		d.full = true
+	}
+	if d.encoder != nil {
+		if err := d.encoder.Encode(decision); err != nil {
+			d.logger.Error("failed to write placement decision to file", zap.Error(err))
+		}
+	}
+}
+
+// List returns the decisions matching the filter, newest first, at most limit if limit > 0.
+func (d *DecisionLog) List(limit int, filter func(PlacementDecision) bool) []PlacementDecision {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	count := d.next
+	if d.full {
+		count = len(d.decisions)
+	}
+	ret := make([]PlacementDecision, 0)
+	for i := 0; i < count; i++ {
+		decision := d.decisions[(d.next-1-i+len(d.decisions))%len(d.decisions)]
+		if filter != nil && !filter(decision) {
+			continue
+		}
+		ret = append(ret, decision)
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+	}
+	return ret
+}
+
+// Close closes the JSONL file, if any.
+func (d *DecisionLog) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
@@ -1,23 +1,35 @@
 package scheduling
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/promclient"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/pyzhm"
+	. "git.helio.dev/eco-qube/target-exporter/pkg/serverswitch"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sync"
 	"time"
 )
 
 type WorkloadSpawnOptions struct {
-	JobName         string
-	CpuTarget       int
-	JobLength       int // in minutes
-	CpuCount        int
-	WorkloadType    string
-	WorkingScenario map[string]float64
-	StartDate       time.Time
-	MinCpuLimit     float64 // in percentage
+	JobName         string             `json:"jobName,omitempty"`
+	CpuTarget       int                `json:"cpuTarget"`
+	JobLength       int                `json:"jobLength"` // in minutes
+	CpuCount        int                `json:"cpuCount"`
+	WorkloadType    string             `json:"workloadType,omitempty"`
+	WorkingScenario map[string]float64 `json:"scenario,omitempty"`
+	StartDate       time.Time          `json:"startDate,omitempty"`
+	MinCpuLimit     float64            `json:"minCpuLimit"`           // in percentage
+	MaxCpuLimit     float64            `json:"maxCpuLimit,omitempty"` // in percentage
+	Template        string             `json:"template,omitempty"`
+	Priority        int                `json:"priority"`
+	Weight          float64            `json:"weight,omitempty"`
+	Deadline        time.Time          `json:"deadline,omitempty"`
 }
 
 type WorkloadSpawnOption func(*WorkloadSpawnOptions)
@@ -70,6 +82,51 @@ func MinCpuLimit(minCpuLimit float64) WorkloadSpawnOption {
 	}
 }
 
+// MaxCpuLimit sets the percentage up to which the self-driving strategy relaxes the CPU limit of the workload.
+func MaxCpuLimit(maxCpuLimit float64) WorkloadSpawnOption {
+	return func(options *WorkloadSpawnOptions) {
+		options.MaxCpuLimit = maxCpuLimit
+	}
+}
+
+// TemplateName selects the job template by name, defaults to the built-in stress template.
+func TemplateName(name string) WorkloadSpawnOption {
+	return func(options *WorkloadSpawnOptions) {
+		options.Template = name
+	}
+}
+
+// Priority sets the priority of the workload, higher values are admitted first, throttled last and relaxed first.
+func Priority(priority int) WorkloadSpawnOption {
+	return func(options *WorkloadSpawnOptions) {
+		options.Priority = priority
+	}
+}
+
+// Weight sets the weight of the workload among the workloads of the same priority, the self-driving strategy throttles
+// and relaxes them in proportion to it.
+func Weight(weight float64) WorkloadSpawnOption {
+	return func(options *WorkloadSpawnOptions) {
+		options.Weight = weight
+	}
+}
+
+// Deadline sets the time after which a workload still waiting in the queue is rejected.
+func Deadline(deadline time.Time) WorkloadSpawnOption {
+	return func(options *WorkloadSpawnOptions) {
+		options.Deadline = deadline
+	}
+}
+
+// ErrInvalidWorkload is returned when the Job of a workload cannot be built, e.g. its template does not exist.
+var ErrInvalidWorkload = errors.New("invalid workload")
+
+// AdmissionDelay is the default time between two admission rounds of the workload queue, and of TAWA placements.
+const AdmissionDelay = 10 * time.Second
+
+// StartJobsInterval is the time between two checks of the suspended jobs to start.
+const StartJobsInterval = 3 * time.Second
+
 type Target struct {
 	Target float64
 	Gauge  prometheus.Gauge
@@ -87,9 +144,23 @@ func (api *Target) GetTarget() float64 {
 type Schedulable struct {
 	Schedulable bool
 	Gauge       prometheus.Gauge
+
+	// mu protects Schedulable and cordoned, which are set by the strategies and the server on/off transitions
+	mu sync.Mutex
+	// cordoned nodes (e.g. being turned off) are kept unschedulable whatever the strategies set
+	cordoned bool
 }
 
 func (api *Schedulable) Set(schedulable bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.set(schedulable)
+}
+
+func (api *Schedulable) set(schedulable bool) {
+	if api.cordoned {
+		schedulable = false
+	}
 	if schedulable {
 		api.Gauge.Set(1)
 	} else {
@@ -98,130 +169,318 @@ func (api *Schedulable) Set(schedulable bool) {
 	api.Schedulable = schedulable
 }
 
+func (api *Schedulable) IsSchedulable() bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.Schedulable
+}
+
+// Cordon sets the node as not Schedulable until Uncordon is called.
+func (api *Schedulable) Cordon() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.cordoned = true
+	api.set(false)
+}
+
+// Uncordon lets the strategies set the node as Schedulable again.
+func (api *Schedulable) Uncordon() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.cordoned = false
+}
+
+func (api *Schedulable) IsCordoned() bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.cordoned
+}
+
 // Orchestrator is responsible for initializing and coordinating the scheduling / optimization strategies.
 type Orchestrator struct {
 	promClient        *Promclient
 	kubeClient        *Kubeclient
-	pyzhmClient       *PyzhmClient
+	placer            Placer
+	jobTemplates      *JobTemplateRegistry
 	selfDriving       *SelfDrivingStrategy
 	schedulable       *SchedulableStrategy
 	tawa              *TawaStrategy
 	serverOnOff       *ServerOnOffStrategy
 	reduceTargets     *ReduceTargetsStrategy
+	thermal           *ThermalStrategy
+	admission         *BaseConcurrentStrategy
+	startJobs         *BaseConcurrentStrategy
+	registry          *StrategyRegistry
+	queue             *WorkloadQueue
+	decisions         *DecisionLog
 	targets           map[string]*Target
-	pyzhmNodeMappings map[string]string
+	pyzhmNodeMappings *NodeMappings
 	setpoints         []float64
 	logger            *zap.Logger
 }
 
 // NewOrchestrator initialized a new orchestrator for all scheduling strategies.
-// By default, the schedulableStrategy is ON, the selfDrivingStrategy is OFF and the tawaStrategy is OFF.
-func NewOrchestrator(kubeClient *Kubeclient, promClient *Promclient, pyzhmClient *PyzhmClient, logger *zap.Logger,
-	targets map[string]*Target, schedulable map[string]*Schedulable, serverOnOff *ServerOnOffStrategy, pyzhmNodeMappings map[string]string,
-	setpoints []float64) *Orchestrator {
-	schedulableStrategy := NewSchedulableStrategy(kubeClient, promClient, logger, targets, schedulable)
-	schedulableStrategy.Start()
+// No strategy runs until Start is called.
+func NewOrchestrator(kubeClient *Kubeclient, promClient *Promclient, placer Placer, jobTemplates *JobTemplateRegistry, decisions *DecisionLog, logger *zap.Logger,
+	targets map[string]*Target, schedulable map[string]*Schedulable, serverOnOff *ServerOnOffStrategy, thermal *ThermalStrategy,
+	pyzhmNodeMappings *NodeMappings, setpoints []float64, arbiter *Arbiter, conflictPolicy ConflictPolicy) *Orchestrator {
 	o := &Orchestrator{
 		promClient:        promClient,
 		kubeClient:        kubeClient,
-		pyzhmClient:       pyzhmClient,
+		placer:            placer,
+		jobTemplates:      jobTemplates,
 		selfDriving:       NewSelfDrivingStrategy(kubeClient, promClient, logger, targets),
-		schedulable:       schedulableStrategy,
-		tawa:              NewTawaStrategy(kubeClient, promClient, logger),
+		schedulable:       NewSchedulableStrategy(kubeClient, promClient, logger, targets, schedulable),
 		serverOnOff:       serverOnOff,
+		thermal:           thermal,
 		reduceTargets:     NewReduceTargetsStrategy(promClient, kubeClient, targets, setpoints, logger),
 		targets:           targets,
 		pyzhmNodeMappings: pyzhmNodeMappings,
 		setpoints:         setpoints,
 		logger:            logger,
+		queue:             NewWorkloadQueue(),
+		decisions:         decisions,
+	}
+	o.tawa = NewTawaStrategy(o, promClient, placer, pyzhmNodeMappings, logger)
+	serverOnOff.WatchQueue(o.queue)
+	o.admission = NewBaseConcurrentStrategy("admission", o.admitWorkloads, logger, Interval(AdmissionDelay), Internal())
+	o.startJobs = NewBaseConcurrentStrategy("startJobs", o.startSuspendedJobs, logger, Interval(StartJobsInterval), Internal())
+
+	o.registry = NewStrategyRegistry(arbiter, conflictPolicy, logger)
+	strategies := []Strategy{o.admission, o.startJobs, o.selfDriving, o.schedulable, o.tawa, o.serverOnOff, o.reduceTargets}
+	if thermal != nil {
+		strategies = append(strategies, thermal)
+	}
+	for _, strategy := range strategies {
+		if err := o.registry.Register(strategy); err != nil {
+			logger.Error("error registering strategy", zap.Error(err))
+		}
 	}
-	go o.CheckStartJobs()
 	return o
 }
 
-func (o *Orchestrator) StartSelfDriving() {
-	o.selfDriving.Start()
+// Start starts the schedulable strategy, enabled by default, and the internal admission and startJobs loops, the
+// others are OFF. All the strategies, including those started later, stop once ctx is done.
+func (o *Orchestrator) Start(ctx context.Context) {
+	o.registry.SetContext(ctx)
+	o.schedulable.Start()
+	o.admission.Start()
+	o.startJobs.Start()
 }
 
-func (o *Orchestrator) StopSelfDriving() {
-	o.selfDriving.Stop()
+// Strategies returns the registry of all the strategies, to list, start, stop and configure them by name.
+func (o *Orchestrator) Strategies() *StrategyRegistry {
+	return o.registry
 }
 
-func (o *Orchestrator) IsSelfDrivingEnabled() bool {
-	return o.selfDriving.IsRunning()
+// RegisterStrategy adds a strategy created outside the orchestrator to the registry, so that it is managed like the
+// others.
+func (o *Orchestrator) RegisterStrategy(strategy Strategy) error {
+	return o.registry.Register(strategy)
 }
 
-func (o *Orchestrator) StartSchedulable() {
-	o.schedulable.Start()
+// SetStrategyInterval changes the reconcile interval and jitter of a strategy by name.
+func (o *Orchestrator) SetStrategyInterval(name string, interval, jitter time.Duration) error {
+	return o.registry.SetInterval(name, interval, jitter)
 }
 
-func (o *Orchestrator) StopSchedulable() {
+// Shutdown stops all the strategies, waiting for the reconciliations in progress to finish.
+func (o *Orchestrator) Shutdown() {
+	o.logger.Info("stopping all strategies")
+	for _, strategy := range o.registry.All() {
+		if strategy != Strategy(o.schedulable) {
+			strategy.Stop()
+		}
+	}
+	// stopped last as stopping it sets all nodes schedulable again
 	o.schedulable.Stop()
 }
 
-func (o *Orchestrator) IsSchedulableEnabled() bool {
-	return o.schedulable.IsRunning()
+// StepDown halts all the strategies, leaving the targets and schedulable gauges as they are, e.g. when another
+// replica becomes the leader.
+func (o *Orchestrator) StepDown() {
+	o.logger.Info("stepping down, halting all strategies")
+	for _, strategy := range o.registry.All() {
+		strategy.Halt()
+	}
 }
 
-func (o *Orchestrator) StartTawa() {
-	o.tawa.Start()
+func (o *Orchestrator) ServerStates() map[string]ServerPowerState {
+	return o.serverOnOff.States()
 }
 
-func (o *Orchestrator) StopTawa() {
-	o.tawa.Stop()
+func (o *Orchestrator) BmcStatuses() []BmcStatus {
+	return o.serverOnOff.BmcStatuses()
 }
 
-func (o *Orchestrator) IsTawaEnabled() bool {
-	return o.tawa.IsRunning()
+// SelfDrivingRecommendations returns the CPU limits recommended by the self-driving strategy in recommend-only mode.
+func (o *Orchestrator) SelfDrivingRecommendations() []CpuLimitRecommendation {
+	return o.selfDriving.Recommendations()
 }
 
-func (o *Orchestrator) StartServerOnOff() {
-	o.serverOnOff.Start()
+// JobTemplateNames returns the names of the job templates workloads can be spawned from.
+func (o *Orchestrator) JobTemplateNames() []string {
+	return o.jobTemplates.Names()
 }
 
-func (o *Orchestrator) StopServerOnOff() {
-	o.serverOnOff.Stop()
+// AddWorkload adds a workload to the queue, it is spawned once admitted. It returns the id of the queued workload.
+func (o *Orchestrator) AddWorkload(options ...WorkloadSpawnOption) (string, error) {
+	ids, err := o.addWorkloads([][]WorkloadSpawnOption{options}, "")
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
 }
 
-func (o *Orchestrator) IsServerOnOffEnabled() bool {
-	return o.serverOnOff.IsRunning()
+// AddWorkloads adds several workloads to the queue as a single batch. If any of them is invalid, none is queued.
+// When TAWA is enabled, the workloads of the batch are placed together in one prediction and either all or none of
+// them are spawned.
+func (o *Orchestrator) AddWorkloads(batch ...[]WorkloadSpawnOption) ([]string, error) {
+	return o.addWorkloads(batch, uuid.New().String())
 }
 
-func (o *Orchestrator) StartReduceTargets() {
-	o.reduceTargets.Start()
+func (o *Orchestrator) addWorkloads(batch [][]WorkloadSpawnOption, batchId string) ([]string, error) {
+	jobNames := make(map[string]bool)
+	spawnOptions := make([]WorkloadSpawnOptions, len(batch))
+	for i, options := range batch {
+		for _, setter := range options {
+			setter(&spawnOptions[i])
+		}
+		// Fail early on unknown templates rather than rejecting the workload later on
+		jobTemplate, err := o.jobTemplates.Get(spawnOptions[i].Template)
+		if err != nil {
+			return nil, err
+		}
+		// Names are assigned upfront as they identify the jobs in pyzhm predictions
+		if spawnOptions[i].JobName == "" {
+			spawnOptions[i].JobName = NewJobName(jobTemplate.Name)
+		}
+		if jobNames[spawnOptions[i].JobName] {
+			return nil, fmt.Errorf("duplicate job name %s", spawnOptions[i].JobName)
+		}
+		jobNames[spawnOptions[i].JobName] = true
+	}
+	items := o.queue.PushBatch(spawnOptions, batchId)
+	ids := make([]string, len(items))
+	for i, item := range items {
+		o.logger.Info("workload queued", zap.String("id", item.Id), zap.String("jobName", item.Options.JobName),
+			zap.String("batchId", batchId), zap.Int("priority", item.Priority))
+		ids[i] = item.Id
+	}
+	return ids, nil
 }
 
-func (o *Orchestrator) StopReduceTargets() {
-	o.reduceTargets.Stop()
+// Placements returns the most recent placement decisions matching the filter, newest first.
+func (o *Orchestrator) Placements(limit int, filter func(PlacementDecision) bool) []PlacementDecision {
+	return o.decisions.List(limit, filter)
 }
 
-func (o *Orchestrator) IsReduceTargetsEnabled() bool {
-	return o.reduceTargets.IsRunning()
+// Queue returns a snapshot of the workload queue.
+func (o *Orchestrator) Queue() QueueSnapshot {
+	return o.queue.Snapshot()
 }
 
-// AddWorkload adds a workload to the queue (for now, it spawns it directly).
-func (o *Orchestrator) AddWorkload(options ...WorkloadSpawnOption) error {
-	spawnOptions := &WorkloadSpawnOptions{}
-	for _, setter := range options {
-		setter(spawnOptions)
+// admitWorkloads releases queued workloads while some node has room (positive CPU diff), at most one workload per
+// node with room per round, every AdmissionDelay by default, so that the diffs can catch up with the newly spawned jobs.
+// When TAWA is enabled, admission and placement are left to the TawaStrategy unless its placer is down.
+func (o *Orchestrator) admitWorkloads(ctx context.Context) error {
+	if o.tawa.IsRunning() && IsAvailable(o.placer) {
+		return nil
+	}
+	eligible := o.queue.Eligible()
+	if len(eligible) == 0 {
+		return nil
+	}
+	diffs, err := o.promClient.GetCurrentCpuDiff()
+	if err != nil {
+		o.logger.Error("failed to get cpu diffs", zap.Error(err))
+		return err
+	}
+	room := 0
+	for _, diff := range diffs {
+		if len(diff.Data) > 0 && diff.Data[0].Usage > 0 {
+			room++
+		}
 	}
+	if room == 0 {
+		o.logger.Debug("no node with positive diff, keeping workloads queued", zap.Int("eligible", len(eligible)))
+		return nil
+	}
+	for i, item := range eligible {
+		if i >= room {
+			break
+		}
+		if err = o.spawnWorkload(item.Options, ""); err != nil {
+			if isPermanentSpawnError(err) {
+				o.queue.Reject(item.Id, err.Error())
+			} else {
+				o.logger.Warn("failed to spawn workload, keeping it queued", zap.String("id", item.Id), zap.Error(err))
+			}
+			continue
+		}
+		o.logger.Info("workload admitted", zap.String("id", item.Id))
+		o.queue.Admit(item.Id, "")
+		o.admission.RecordAction()
+	}
+	return nil
+}
 
-	builder := NewConcreteStressJobBuilder()
-	// TODO: get node name dynamically https://www.notion.so/helioag/Map-input-percentage-of-cpu-limits-to-range-of-CPUs-for-node-c6bd901a457243d5afece2ae0a9ac150?pvs=4
-	var dummy string
-	for k, _ := range o.targets {
-		dummy = k
-		break
+// spawnWorkload builds and creates the Job of a workload, bound to nodeName if not empty.
+func (o *Orchestrator) spawnWorkload(spawnOptions WorkloadSpawnOptions, nodeName string) error {
+	job, err := o.buildJob(spawnOptions, nodeName)
+	if err != nil {
+		return err
 	}
+	err = o.kubeClient.SpawnNewWorkload(job)
+	if err != nil {
+		o.logger.Error("failed to spawn new workload", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// spawnWorkloads creates the Jobs of several workloads atomically: all jobs are built first and, if creating one of
+// them fails, the already created ones are deleted.
+func (o *Orchestrator) spawnWorkloads(spawnOptions []WorkloadSpawnOptions, nodeNames []string) error {
+	jobs := make([]*StressJob, len(spawnOptions))
+	for i := range spawnOptions {
+		job, err := o.buildJob(spawnOptions[i], nodeNames[i])
+		if err != nil {
+			return err
+		}
+		jobs[i] = job
+	}
+	for i, job := range jobs {
+		if err := o.kubeClient.SpawnNewWorkload(job); err != nil {
+			o.logger.Error("failed to spawn new workload, rolling back batch", zap.Error(err))
+			for _, created := range jobs[:i] {
+				if deleteErr := o.kubeClient.DeleteWorkload(created.GetName()); deleteErr != nil {
+					o.logger.Error("failed to roll back workload", zap.String("jobName", created.GetName()), zap.Error(deleteErr))
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Orchestrator) buildJob(spawnOptions WorkloadSpawnOptions, nodeName string) (*StressJob, error) {
+	jobTemplate, err := o.jobTemplates.Get(spawnOptions.Template)
+	if err != nil {
+		o.logger.Error("failed to get job template", zap.Error(err))
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWorkload, err)
+	}
+
+	builder := NewConcreteStressJobBuilder()
 	cpuCounts, err := o.promClient.GetCpuCounts()
 	if err != nil {
 		o.logger.Error("failed to get cpu counts", zap.Error(err))
-		return err
+		return nil, err
 	}
-	cpuTarget, err := PercentageToResourceQuantity(cpuCounts, float64(spawnOptions.CpuTarget), dummy)
+	cpuTarget, err := PercentageToResourceQuantity(cpuCounts, float64(spawnOptions.CpuTarget), o.referenceNodeName())
 	if err != nil {
 		o.logger.Error("failed to convert cpu target to resource quantity", zap.Error(err))
-		return err
+		return nil, err
 	}
 
 	jobBuilder := builder.
@@ -229,95 +488,66 @@ func (o *Orchestrator) AddWorkload(options ...WorkloadSpawnOption) error {
 		WithCpuCount(spawnOptions.CpuCount).
 		WithCpuLimit(cpuTarget).
 		WithMinCpuLimit(spawnOptions.MinCpuLimit).
+		WithMaxCpuLimit(spawnOptions.MaxCpuLimit).
+		WithPriority(spawnOptions.Priority).
+		WithWeight(spawnOptions.Weight).
 		WithLength(MinutesToDuration(spawnOptions.JobLength)).
 		// TODO: maybe needs more "intelligence"? for now, workload type -> hardware directly but in the future
 		// it could be necessary to map workload type to hardware type depending on what type of workload we get
 		// (e.g. AI workload -> GPU, etc.)
 		WithWorkloadType(HardwareTarget(spawnOptions.WorkloadType)).
-		WithStartDate(spawnOptions.StartDate)
-
-	// Check if scenario present in HTTP request, if yes, don't read from Prometheus
-	if o.IsTawaEnabled() {
-		var currentEnergyConsumption map[string]float64
-		if spawnOptions.WorkingScenario == nil || len(spawnOptions.WorkingScenario) == 0 {
-			currentEnergyConsumption, err = o.promClient.GetCurrentEnergyConsumption()
-		} else {
-			currentEnergyConsumption = spawnOptions.WorkingScenario
-		}
-		if err != nil {
-			o.logger.Error("failed to get current energy consumption", zap.Error(err))
-			return err
-		}
-
-		scenario := Scenario{
-			Scenario:     make(map[string]float64),
-			Requirements: make(map[string]float64),
-		}
-		// Map result to Scenario
-		for k, v := range currentEnergyConsumption {
-			scenario.Scenario[k] = v
-		}
-
-		coreCount, err := PercentageToResourceQuantity(cpuCounts, float64(spawnOptions.CpuTarget), dummy)
-		if err != nil {
-			o.logger.Error("failed to convert cpu target to resource quantity", zap.Error(err))
-			return err
-		}
-		scenario.Requirements["job1"] = float64(coreCount.Value())
-
-		predictions, err := o.pyzhmClient.Predict(scenario)
-		if err != nil {
-			o.logger.Error("failed to get predictions from pyzhm", zap.Error(err))
-			return err
-		}
-
-		// Map node names according to yaml config since pyzhm uses different node names than Kubernetes node names
-		actualNodeName := o.pyzhmNodeMappings[predictions.Assignments["job1"]]
-		// Add node only if selection is on a node currently with actual_cpu < target_cpu, otherwise, continue
-		diffNode, err := o.promClient.GetNodeCpuDiff(actualNodeName)
-		if err != nil {
-			o.logger.Error("failed to get node cpu diff", zap.Error(err))
-			return err
-		}
-		if diffNode > 0 {
-			jobBuilder.WithNodeSelector(actualNodeName)
-		}
+		WithStartDate(spawnOptions.StartDate).
+		WithTemplate(jobTemplate)
+	if nodeName != "" {
+		jobBuilder.WithNodeSelector(nodeName)
 	}
 	job, err := jobBuilder.Build()
 	if err != nil {
 		o.logger.Error("failed to build job", zap.Error(err))
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWorkload, err)
 	}
+	return job, nil
+}
 
-	err = o.kubeClient.SpawnNewWorkload(job)
-	if err != nil {
-		o.logger.Error("failed to spawn new workload", zap.Error(err))
-		return err
+// isPermanentSpawnError returns whether spawning a workload failed for good, e.g. an unknown template or a Job
+// rejected by the API server, as opposed to transient errors, e.g. the API server or Prometheus being unreachable,
+// after which the workload is retried.
+func isPermanentSpawnError(err error) bool {
+	return errors.Is(err, ErrInvalidWorkload) || errors.Is(err, ErrInvalidJob) || apierrors.IsInvalid(err) ||
+		apierrors.IsBadRequest(err) || apierrors.IsAlreadyExists(err) || apierrors.IsForbidden(err)
+}
+
+// referenceNodeName returns the node whose CPU count is used to convert CPU percentages of new workloads to cores.
+// TODO: get node name dynamically https://www.notion.so/helioag/Map-input-percentage-of-cpu-limits-to-range-of-CPUs-for-node-c6bd901a457243d5afece2ae0a9ac150?pvs=4
+func (o *Orchestrator) referenceNodeName() string {
+	for k, _ := range o.targets {
+		return k
 	}
-	return nil
+	return ""
 }
 
-func (o *Orchestrator) CheckStartJobs() {
-	for {
-		suspendedJobs, err := o.kubeClient.GetSuspendedJobs()
-		if err != nil {
-			o.logger.Error("Error getting suspended jobs from API", zap.Error(err))
-		}
-		for _, suspendedJob := range suspendedJobs {
-			suspendedAnnotation := suspendedJob.Annotations[JobStartDateAnnotation]
-			if suspendedAnnotation != "" {
-				jobStartDate, err := time.Parse(time.RFC3339, suspendedJob.Annotations[JobStartDateAnnotation])
+// startSuspendedJobs starts the suspended jobs whose start date is passed.
+func (o *Orchestrator) startSuspendedJobs(ctx context.Context) error {
+	suspendedJobs, err := o.kubeClient.GetSuspendedJobs()
+	if err != nil {
+		o.logger.Error("Error getting suspended jobs from API", zap.Error(err))
+	}
+	for _, suspendedJob := range suspendedJobs {
+		suspendedAnnotation := suspendedJob.Annotations[JobStartDateAnnotation]
+		if suspendedAnnotation != "" {
+			jobStartDate, err := time.Parse(time.RFC3339, suspendedJob.Annotations[JobStartDateAnnotation])
+			if err != nil {
+				o.logger.Error("Error parsing date from JobSelectorLabel annotation", zap.Error(err))
+			}
+			if jobStartDate.Before(time.Now()) {
+				err = o.kubeClient.StartSuspendedJob(suspendedJob.Name)
 				if err != nil {
-					o.logger.Error("Error parsing date from JobSelectorLabel annotation", zap.Error(err))
-				}
-				if jobStartDate.Before(time.Now()) {
-					err = o.kubeClient.StartSuspendedJob(suspendedJob.Name)
-					if err != nil {
-						o.logger.Error("Error starting suspended job", zap.Error(err))
-					}
+					o.logger.Error("Error starting suspended job", zap.Error(err))
+					continue
 				}
+				o.startJobs.RecordAction()
 			}
 		}
-		time.Sleep(3 * time.Second)
 	}
+	return nil
 }
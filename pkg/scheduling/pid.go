@@ -0,0 +1,80 @@
+package scheduling
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"math"
+	"time"
+)
+
+var (
+	controllerError = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "target_exporter_controller_error",
+		Help: "Error of the self-driving CPU limit controller, i.e. the target minus the CPU usage of the node in percentage.",
+	}, []string{"node"})
+	controllerOutput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "target_exporter_controller_output",
+		Help: "Output of the self-driving CPU limit controller, i.e. the change of the CPU limits of the node pods in percentage.",
+	}, []string{"node"})
+)
+
+// PidGains are the proportional, integral and derivative gains of a PID controller.
+type PidGains struct {
+	Kp float64 `json:"kp"`
+	Ki float64 `json:"ki"`
+	Kd float64 `json:"kd"`
+}
+
+// PidController is a PID controller whose integral term is bounded. Its output is clamped, and when the output is
+// saturated the integral term is not accumulated, so that it does not wind up while the output cannot follow.
+type PidController struct {
+	Gains         PidGains
+	IntegralLimit float64
+	MaxOutput     float64
+
+	integral     float64
+	prevIntegral float64
+	lastError    float64
+	lastTime     time.Time
+}
+
+// Update returns the output of the controller for the error measured at now.
+func (c *PidController) Update(err float64, now time.Time) float64 {
+	derivative := 0.0
+	c.prevIntegral = c.integral
+	if !c.lastTime.IsZero() {
+		dt := now.Sub(c.lastTime).Seconds()
+		if dt > 0 {
+			c.integral += err * dt
+			derivative = (err - c.lastError) / dt
+		}
+	}
+	if c.IntegralLimit > 0 {
+		c.integral = math.Max(-c.IntegralLimit, math.Min(c.IntegralLimit, c.integral))
+	}
+	c.lastError = err
+	c.lastTime = now
+
+	output := c.Gains.Kp*err + c.Gains.Ki*c.integral + c.Gains.Kd*derivative
+	if c.MaxOutput > 0 && math.Abs(output) > c.MaxOutput {
+		output = math.Copysign(c.MaxOutput, output)
+		c.Saturated()
+	}
+	return output
+}
+
+// Saturated discards the integration of the last update, to be called when its output could not be applied.
+func (c *PidController) Saturated() {
+	c.integral = c.prevIntegral
+}
+
+// Due returns whether a sample period passed since the last update.
+func (c *PidController) Due(now time.Time, samplePeriod time.Duration) bool {
+	return c.lastTime.IsZero() || now.Sub(c.lastTime) >= samplePeriod
+}
+
+// Reset clears the state of the controller, e.g. when there is nothing left to control.
+func (c *PidController) Reset() {
+	c.integral, c.prevIntegral, c.lastError = 0, 0, 0
+	c.lastTime = time.Time{}
+}
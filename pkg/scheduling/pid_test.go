@@ -0,0 +1,129 @@
+package scheduling
+
+import (
+	"git.helio.dev/eco-qube/target-exporter/pkg/promclient"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+	"testing"
+	"time"
+)
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestPidControllerUpdate(t *testing.T) {
+	c := &PidController{Gains: PidGains{Kp: 0.5, Ki: 0.1, Kd: 2}}
+	start := time.Unix(0, 0)
+
+	// The first update has no elapsed time, only the proportional term applies
+	if output := c.Update(10, start); !almostEqual(output, 5) {
+		t.Fatalf("first output = %f, want 5", output)
+	}
+	// 10s later: integral = 4*10 = 40, derivative = (4-10)/10 = -0.6
+	if output := c.Update(4, start.Add(10*time.Second)); !almostEqual(output, 0.5*4+0.1*40+2*-0.6) {
+		t.Fatalf("second output = %f, want %f", output, 0.5*4+0.1*40+2*-0.6)
+	}
+	if !almostEqual(c.integral, 40) {
+		t.Fatalf("integral = %f, want 40", c.integral)
+	}
+}
+
+func TestPidControllerIntegralLimit(t *testing.T) {
+	c := &PidController{Gains: PidGains{Ki: 1}, IntegralLimit: 50}
+	start := time.Unix(0, 0)
+	c.Update(10, start)
+	if output := c.Update(10, start.Add(time.Minute)); !almostEqual(output, 50) {
+		t.Fatalf("output = %f, want the integral limit 50", output)
+	}
+	if output := c.Update(-10, start.Add(2*time.Minute)); !almostEqual(output, -50) {
+		t.Fatalf("output = %f, want -50", output)
+	}
+}
+
+func TestPidControllerAntiWindup(t *testing.T) {
+	c := &PidController{Gains: PidGains{Kp: 1, Ki: 1}, MaxOutput: 20}
+	start := time.Unix(0, 0)
+	c.Update(30, start)
+	// Saturated output: the integration of the update is discarded
+	if output := c.Update(30, start.Add(time.Second)); output != 20 {
+		t.Fatalf("output = %f, want MaxOutput 20", output)
+	}
+	if c.integral != 0 {
+		t.Fatalf("integral = %f while saturated, want 0", c.integral)
+	}
+	if output := c.Update(-30, start.Add(2*time.Second)); output != -20 {
+		t.Fatalf("output = %f, want -20", output)
+	}
+
+	// Not saturated: the integral accumulates until the output cannot be applied
+	c.Reset()
+	c.Update(5, start)
+	c.Update(5, start.Add(time.Second))
+	if !almostEqual(c.integral, 5) {
+		t.Fatalf("integral = %f, want 5", c.integral)
+	}
+	c.Update(5, start.Add(2*time.Second))
+	c.Saturated()
+	if !almostEqual(c.integral, 5) {
+		t.Fatalf("integral = %f after Saturated, want 5", c.integral)
+	}
+}
+
+func TestPidControllerDue(t *testing.T) {
+	c := &PidController{}
+	start := time.Unix(0, 0)
+	if !c.Due(start, time.Minute) {
+		t.Fatal("new controller not due")
+	}
+	c.Update(1, start)
+	if c.Due(start.Add(30*time.Second), time.Minute) {
+		t.Fatal("controller due before its sample period")
+	}
+	if !c.Due(start.Add(time.Minute), time.Minute) {
+		t.Fatal("controller not due after its sample period")
+	}
+	c.Reset()
+	if !c.Due(start, time.Minute) {
+		t.Fatal("reset controller not due")
+	}
+}
+
+func testShare(name string, cpuLimit, minCpuLimit, maxCpuLimit float64, priority int, weight float64) podShare {
+	return podShare{
+		pod:         v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}},
+		cpuLimit:    cpuLimit,
+		minCpuLimit: minCpuLimit,
+		maxCpuLimit: maxCpuLimit,
+		priority:    priority,
+		weight:      weight,
+	}
+}
+
+func TestControlStep(t *testing.T) {
+	shares := []podShare{testShare("a", 40, 10, 100, 0, 1), testShare("b", 40, 10, 100, 0, 1)}
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name string
+		diff float64
+		sign float64
+	}{
+		// The diff is the target minus the usage
+		{"node with headroom relaxes", 10, 1},
+		{"node above target throttles", -10, -1},
+	}
+	for _, tt := range tests {
+		controller := &PidController{Gains: PidGains{Kp: 1}, MaxOutput: 20}
+		nodeDiff := promclient.NodeCpuUsage{NodeName: "node", Data: []promclient.InstantCpuUsage{{Usage: tt.diff}}}
+		controlErr, output, updates := controlStep(controller, nodeDiff, shares, start)
+		if controlErr != tt.diff || output != tt.diff {
+			t.Fatalf("%s: error %f and output %f, want %f", tt.name, controlErr, output, tt.diff)
+		}
+		for _, name := range []string{"a", "b"} {
+			if !almostEqual(updates[name], tt.sign*5) {
+				t.Fatalf("%s: update of %s = %f, want %f", tt.name, name, updates[name], tt.sign*5)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package scheduling
+
+import (
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+type WorkloadStatus string
+
+const (
+	WorkloadQueued   WorkloadStatus = "queued"
+	WorkloadAdmitted WorkloadStatus = "admitted"
+	WorkloadRejected WorkloadStatus = "rejected"
+)
+
+// MaxQueueHistory is how many admitted and rejected workloads are kept around for inspection.
+const MaxQueueHistory = 100
+
+const (
+	ReasonDeadlineExceeded = "deadline exceeded while queued"
+)
+
+// QueuedWorkload is a workload submission waiting for, or having gone through, admission.
+type QueuedWorkload struct {
+	Id          string               `json:"id"`
+	BatchId     string               `json:"batchId,omitempty"`
+	Options     WorkloadSpawnOptions `json:"options"`
+	Priority    int                  `json:"priority"`
+	Deadline    time.Time            `json:"deadline,omitempty"`
+	SubmittedAt time.Time            `json:"submittedAt"`
+	Status      WorkloadStatus       `json:"status"`
+	Reason      string               `json:"reason,omitempty"`
+	NodeName    string               `json:"nodeName,omitempty"`
+	UpdatedAt   time.Time            `json:"updatedAt"`
+}
+
+// isEligible returns whether the workload can be admitted at the given time, i.e. its start date has passed.
+func (w *QueuedWorkload) isEligible(now time.Time) bool {
+	return !w.Options.StartDate.After(now)
+}
+
+func (w *QueuedWorkload) isExpired(now time.Time) bool {
+	return !w.Deadline.IsZero() && w.Deadline.Before(now)
+}
+
+// QueueSnapshot is a point-in-time copy of the queue content.
+type QueueSnapshot struct {
+	Queued   []QueuedWorkload `json:"queued"`
+	Admitted []QueuedWorkload `json:"admitted"`
+	Rejected []QueuedWorkload `json:"rejected"`
+}
+
+// WorkloadQueue is an in-process priority queue of workload submissions. Workloads with higher priority are released
+// first, ties are broken by submission time.
+type WorkloadQueue struct {
+	mu       sync.Mutex
+	queued   []*QueuedWorkload
+	admitted []*QueuedWorkload
+	rejected []*QueuedWorkload
+}
+
+func NewWorkloadQueue() *WorkloadQueue {
+	return &WorkloadQueue{
+		queued:   make([]*QueuedWorkload, 0),
+		admitted: make([]*QueuedWorkload, 0),
+		rejected: make([]*QueuedWorkload, 0),
+	}
+}
+
+// Push adds a new submission to the queue.
+func (q *WorkloadQueue) Push(options WorkloadSpawnOptions) *QueuedWorkload {
+	return q.PushBatch([]WorkloadSpawnOptions{options}, "")[0]
+}
+
+// PushBatch adds several submissions at once. Workloads sharing a non-empty batch id are placed together.
+func (q *WorkloadQueue) PushBatch(batch []WorkloadSpawnOptions, batchId string) []*QueuedWorkload {
+	now := time.Now()
+	items := make([]*QueuedWorkload, len(batch))
+	for i, options := range batch {
+		items[i] = &QueuedWorkload{
+			Id:          uuid.New().String(),
+			BatchId:     batchId,
+			Options:     options,
+			Priority:    options.Priority,
+			Deadline:    options.Deadline,
+			SubmittedAt: now,
+			Status:      WorkloadQueued,
+			UpdatedAt:   now,
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queued = append(q.queued, items...)
+	sort.SliceStable(q.queued, func(i, j int) bool {
+		if q.queued[i].Priority != q.queued[j].Priority {
+			return q.queued[i].Priority > q.queued[j].Priority
+		}
+		return q.queued[i].SubmittedAt.Before(q.queued[j].SubmittedAt)
+	})
+	return items
+}
+
+// Eligible returns, in priority order, the queued workloads whose start date has passed. Workloads whose deadline
+// expired are rejected on the way.
+func (q *WorkloadQueue) Eligible() []*QueuedWorkload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	eligible := make([]*QueuedWorkload, 0)
+	remaining := make([]*QueuedWorkload, 0, len(q.queued))
+	for _, item := range q.queued {
+		if item.isExpired(now) {
+			q.reject(item, ReasonDeadlineExceeded)
+			continue
+		}
+		if item.isEligible(now) {
+			eligible = append(eligible, item)
+		}
+		remaining = append(remaining, item)
+	}
+	q.queued = remaining
+	return eligible
+}
+
+// Admit marks a queued workload as admitted on the given node (empty if left to the Kubernetes scheduler).
+func (q *WorkloadQueue) Admit(id, nodeName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item := q.remove(id); item != nil {
+		item.Status = WorkloadAdmitted
+		item.NodeName = nodeName
+		item.UpdatedAt = time.Now()
+		q.admitted = appendBounded(q.admitted, item)
+	}
+}
+
+// Reject removes a queued workload from the queue recording why it was not admitted.
+func (q *WorkloadQueue) Reject(id, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item := q.remove(id); item != nil {
+		q.reject(item, reason)
+	}
+}
+
+// Snapshot returns a copy of the queued, admitted and rejected workloads.
+func (q *WorkloadQueue) Snapshot() QueueSnapshot {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueSnapshot{
+		Queued:   copyWorkloads(q.queued),
+		Admitted: copyWorkloads(q.admitted),
+		Rejected: copyWorkloads(q.rejected),
+	}
+}
+
+// Len returns the number of workloads still waiting for admission.
+func (q *WorkloadQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queued)
+}
+
+// reject must be called with the lock held and the item already removed from the queued list.
+func (q *WorkloadQueue) reject(item *QueuedWorkload, reason string) {
+	item.Status = WorkloadRejected
+	item.Reason = reason
+	item.UpdatedAt = time.Now()
+	q.rejected = appendBounded(q.rejected, item)
+}
+
+func (q *WorkloadQueue) remove(id string) *QueuedWorkload {
+	for i, item := range q.queued {
+		if item.Id == id {
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			return item
+		}
+	}
+	return nil
+}
+
+func appendBounded(items []*QueuedWorkload, item *QueuedWorkload) []*QueuedWorkload {
+	items = append(items, item)
+	if len(items) > MaxQueueHistory {
+		items = items[len(items)-MaxQueueHistory:]
+	}
+	return items
+}
+
+func copyWorkloads(items []*QueuedWorkload) []QueuedWorkload {
+	ret := make([]QueuedWorkload, len(items))
+	for i, item := range items {
+		ret[i] = *item
+	}
+	return ret
+}
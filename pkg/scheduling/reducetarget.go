@@ -1,12 +1,15 @@
 package scheduling
 
 import (
+	"context"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/promclient"
 	"go.uber.org/zap"
 	"time"
 )
 
+const ReduceTargetsInterval = 2 * time.Second
+
 type ReduceTargetsStrategy struct {
 	*BaseConcurrentStrategy
 
@@ -25,11 +28,13 @@ func NewReduceTargetsStrategy(promClient *Promclient, kubeClient *Kubeclient, ta
 		setpoints:  setpoints,
 		logger:     logger,
 	}
-	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("reduceTargets", strategy.Reconcile, logger.With(zap.String("strategy", "reduceTargets")))
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("reduceTargets", strategy.Reconcile,
+		logger.With(zap.String("strategy", "reduceTargets")), Interval(ReduceTargetsInterval),
+		Mutates(ResourceTargets))
 	return strategy
 }
 
-func (r *ReduceTargetsStrategy) Reconcile() error {
+func (r *ReduceTargetsStrategy) Reconcile(ctx context.Context) error {
 	// If targets are below their target since X time, reduce to previous set point
 	avgCpuUsage, err := r.promClient.GetAvgCpuUsages(5)
 	if err != nil {
@@ -40,27 +45,20 @@ func (r *ReduceTargetsStrategy) Reconcile() error {
 		for _, avgUsage := range avgCpuUsage {
 			if avgUsage.NodeName == nodeName && avgUsage.Data < target.GetTarget() {
 				// Reduce target
+				release, ok := r.Acquire(nodeName, ResourceTargets)
+				if !ok {
+					continue
+				}
 				r.logger.Info("reducing target", zap.String("node", nodeName), zap.Float64("target", target.GetTarget()))
 				target.Set(getLowerSetpoint(r.setpoints, target.GetTarget()))
+				release()
+				r.RecordAction()
 			}
 		}
 	}
-	time.Sleep(1 * time.Second)
 	return nil
 }
 
-func (r *ReduceTargetsStrategy) IsAutomaticJobSpawnEnabled() bool {
-	return r.isRunning
-}
-
-func (r *ReduceTargetsStrategy) Start() {
-	r.BaseConcurrentStrategy.Start()
-}
-
-func (r *ReduceTargetsStrategy) Stop() {
-	r.BaseConcurrentStrategy.Stop()
-}
-
 func getLowerSetpoint(setpoints []float64, currentTarget float64) float64 {
 	for _, setpoint := range setpoints {
 		if setpoint < currentTarget {
@@ -0,0 +1,400 @@
+package scheduling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownStrategy  = errors.New("unknown strategy")
+	ErrStrategyConflict = errors.New("strategy conflicts with a running strategy")
+	ErrStrategyInternal = errors.New("internal strategy cannot be started or stopped")
+)
+
+// Strategy is a concurrent strategy managed through the StrategyRegistry, all strategies embedding a
+// BaseConcurrentStrategy implement it.
+type Strategy interface {
+	ConcurrentStrategy
+	Name() string
+	Stats() StrategyStats
+	SetInterval(interval, jitter time.Duration)
+	Resources() []Resource
+	SetArbiter(arbiter *Arbiter)
+	SetContext(ctx context.Context)
+	Halt()
+}
+
+// ParameterizedStrategy is a Strategy whose parameters can be read and updated at runtime.
+type ParameterizedStrategy interface {
+	Strategy
+	// Parameters returns the current parameters, they are marshalled as JSON
+	Parameters() interface{}
+	// SetParameters updates the parameters set in the JSON document, the others are kept
+	SetParameters(data []byte) error
+}
+
+// StrategyRegistry keeps the strategies by name, so that they can all be listed, started, stopped and configured the
+// same way. The registered strategies share the arbiter, and starting a strategy mutating the same resources as a
+// running one is warned about or rejected depending on the conflict policy.
+type StrategyRegistry struct {
+	arbiter *Arbiter
+	policy  ConflictPolicy
+	logger  *zap.Logger
+
+	mu         sync.RWMutex
+	strategies map[string]Strategy
+	store      StateStore
+	// persistMu serializes the saves of the state
+	persistMu sync.Mutex
+}
+
+func NewStrategyRegistry(arbiter *Arbiter, policy ConflictPolicy, logger *zap.Logger) *StrategyRegistry {
+	if policy == "" {
+		policy = ConflictWarn
+	}
+	return &StrategyRegistry{
+		arbiter:    arbiter,
+		policy:     policy,
+		logger:     logger,
+		strategies: make(map[string]Strategy),
+	}
+}
+
+// Register adds a strategy, its name must be unique.
+func (r *StrategyRegistry) Register(strategy Strategy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.strategies[strategy.Name()]; ok {
+		return fmt.Errorf("strategy %s already registered", strategy.Name())
+	}
+	strategy.SetArbiter(r.arbiter)
+	r.strategies[strategy.Name()] = strategy
+	return nil
+}
+
+// SetStore sets where the state of the strategies is persisted each time a strategy is started, stopped or
+// reconfigured through the registry.
+func (r *StrategyRegistry) SetStore(store StateStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = store
+}
+
+// SetContext sets the context the strategies stop with, from their next start.
+func (r *StrategyRegistry) SetContext(ctx context.Context) {
+	for _, strategy := range r.All() {
+		strategy.SetContext(ctx)
+	}
+}
+
+// Start starts a strategy and returns the running strategies it conflicts with. With the reject policy, it is not
+// started if there is any.
+func (r *StrategyRegistry) Start(name string) ([]Conflict, error) {
+	conflicts, err := r.start(name)
+	if err != nil {
+		return conflicts, err
+	}
+	r.persist()
+	return conflicts, nil
+}
+
+func (r *StrategyRegistry) start(name string) ([]Conflict, error) {
+	conflicts, err := r.CheckStart(name)
+	if err != nil {
+		return conflicts, err
+	}
+	for _, conflict := range conflicts {
+		r.logger.Warn("starting conflicting strategies", zap.String("strategy", conflict.Strategy),
+			zap.String("other", conflict.Other), zap.String("resource", string(conflict.Resource)),
+			zap.String("policy", string(r.policy)))
+	}
+	strategy, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	strategy.Start()
+	return conflicts, nil
+}
+
+// CheckStart returns the running strategies a strategy conflicts with, and the error Start would return, without
+// starting it.
+func (r *StrategyRegistry) CheckStart(name string) ([]Conflict, error) {
+	strategy, err := r.toggleable(name)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := make([]Conflict, 0)
+	for _, other := range r.All() {
+		if other.IsRunning() {
+			conflicts = append(conflicts, Conflicts(strategy, other)...)
+		}
+	}
+	if len(conflicts) > 0 && r.policy == ConflictReject {
+		return conflicts, fmt.Errorf("%w: %s", ErrStrategyConflict, conflicts[0])
+	}
+	return conflicts, nil
+}
+
+// Stop stops a strategy.
+func (r *StrategyRegistry) Stop(name string) error {
+	strategy, err := r.toggleable(name)
+	if err != nil {
+		return err
+	}
+	strategy.Stop()
+	r.persist()
+	return nil
+}
+
+// SetInterval changes the reconcile interval and jitter of a strategy.
+func (r *StrategyRegistry) SetInterval(name string, interval, jitter time.Duration) error {
+	strategy, err := r.Get(name)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 || jitter < 0 {
+		return fmt.Errorf("invalid interval %s or jitter %s for strategy %s", interval, jitter, name)
+	}
+	strategy.SetInterval(interval, jitter)
+	r.persist()
+	return nil
+}
+
+func (r *StrategyRegistry) Get(name string) (Strategy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	strategy, ok := r.strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, name)
+	}
+	return strategy, nil
+}
+
+// toggleable returns the strategy, unless it is internal.
+func (r *StrategyRegistry) toggleable(name string) (Strategy, error) {
+	strategy, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if strategy.Stats().Internal {
+		return nil, fmt.Errorf("%w: %s", ErrStrategyInternal, name)
+	}
+	return strategy, nil
+}
+
+// All returns the strategies sorted by name.
+func (r *StrategyRegistry) All() []Strategy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	strategies := make([]Strategy, 0, len(r.strategies))
+	for _, strategy := range r.strategies {
+		strategies = append(strategies, strategy)
+	}
+	sort.Slice(strategies, func(i, j int) bool {
+		return strategies[i].Name() < strategies[j].Name()
+	})
+	return strategies
+}
+
+// Stats returns the state and statistics of every strategy, sorted by name.
+func (r *StrategyRegistry) Stats() []StrategyStats {
+	stats := make([]StrategyStats, 0)
+	for _, strategy := range r.All() {
+		stats = append(stats, strategy.Stats())
+	}
+	return stats
+}
+
+// Parameters returns the parameters of a strategy, nil if it has none.
+func (r *StrategyRegistry) Parameters(name string) (interface{}, error) {
+	strategy, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if parameterized, ok := strategy.(ParameterizedStrategy); ok {
+		return parameterized.Parameters(), nil
+	}
+	return nil, nil
+}
+
+// SetParameters updates the parameters of a strategy from a JSON document.
+func (r *StrategyRegistry) SetParameters(name string, data []byte) error {
+	strategy, err := r.Get(name)
+	if err != nil {
+		return err
+	}
+	parameterized, ok := strategy.(ParameterizedStrategy)
+	if !ok {
+		return fmt.Errorf("strategy %s has no parameters", name)
+	}
+	if err = parameterized.SetParameters(data); err != nil {
+		return err
+	}
+	r.persist()
+	return nil
+}
+
+// State returns the current state of every strategy by name, internal strategies excepted.
+func (r *StrategyRegistry) State() map[string]StrategyState {
+	states := make(map[string]StrategyState)
+	for _, strategy := range r.All() {
+		stats := strategy.Stats()
+		if stats.Internal {
+			continue
+		}
+		state := StrategyState{
+			Enabled:  stats.Running,
+			Interval: stats.Interval,
+			Jitter:   stats.Jitter,
+		}
+		if parameterized, ok := strategy.(ParameterizedStrategy); ok {
+			parameters, err := json.Marshal(parameterized.Parameters())
+			if err != nil {
+				r.logger.Error("error marshalling strategy parameters", zap.String("strategy", stats.Name),
+					zap.Error(err))
+			} else {
+				state.Parameters = parameters
+			}
+		}
+		states[stats.Name] = state
+	}
+	return states
+}
+
+// Restore restores the state saved in the store, if any, and returns whether there was one. Strategies missing from
+// the saved state are left as they are.
+func (r *StrategyRegistry) Restore() (bool, error) {
+	r.mu.RLock()
+	store := r.store
+	r.mu.RUnlock()
+	if store == nil {
+		return false, nil
+	}
+	data, err := store.Load()
+	if err != nil || data == nil {
+		return false, err
+	}
+	states := make(map[string]StrategyState)
+	if err = json.Unmarshal(data, &states); err != nil {
+		return false, fmt.Errorf("invalid strategies state: %w", err)
+	}
+	r.Apply(states)
+	return true, nil
+}
+
+// Apply sets the interval and parameters of the strategies and starts or stops them, without persisting the state.
+func (r *StrategyRegistry) Apply(states map[string]StrategyState) {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Stop first, so that the strategies started afterwards do not conflict with strategies being stopped
+	for _, name := range names {
+		if !states[name].Enabled {
+			r.apply(name, states[name])
+		}
+	}
+	for _, name := range names {
+		if states[name].Enabled {
+			r.apply(name, states[name])
+		}
+	}
+}
+
+func (r *StrategyRegistry) apply(name string, state StrategyState) {
+	logger := r.logger.With(zap.String("strategy", name))
+	strategy, err := r.Get(name)
+	if err != nil {
+		logger.Warn("ignoring state of unknown strategy")
+		return
+	}
+	if strategy.Stats().Internal {
+		logger.Warn("ignoring state of internal strategy")
+		return
+	}
+	if state.Interval != "" {
+		interval, jitter, err := parseInterval(state.Interval, state.Jitter)
+		if err != nil {
+			logger.Error("invalid interval, keeping the default", zap.Error(err))
+		} else {
+			strategy.SetInterval(interval, jitter)
+		}
+	}
+	if parameterized, ok := strategy.(ParameterizedStrategy); ok && len(state.Parameters) > 0 {
+		if err = parameterized.SetParameters(state.Parameters); err != nil {
+			logger.Error("invalid parameters", zap.Error(err))
+		}
+	}
+	if !state.Enabled {
+		strategy.Stop()
+		return
+	}
+	if _, err = r.start(name); err != nil {
+		logger.Error("error starting strategy", zap.Error(err))
+	}
+}
+
+// parseInterval parses a persisted interval and jitter, an empty jitter is none.
+func parseInterval(interval, jitter string) (time.Duration, time.Duration, error) {
+	intervalDuration, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	var jitterDuration time.Duration
+	if jitter != "" {
+		if jitterDuration, err = time.ParseDuration(jitter); err != nil {
+			return 0, 0, err
+		}
+	}
+	if intervalDuration <= 0 || jitterDuration < 0 {
+		return 0, 0, fmt.Errorf("invalid interval %s or jitter %s", interval, jitter)
+	}
+	return intervalDuration, jitterDuration, nil
+}
+
+// persist saves the state of the strategies, if a store is set.
+func (r *StrategyRegistry) persist() {
+	r.mu.RLock()
+	store := r.store
+	r.mu.RUnlock()
+	if store == nil {
+		return
+	}
+	r.persistMu.Lock()
+	defer r.persistMu.Unlock()
+	data, err := json.MarshalIndent(r.State(), "", "  ")
+	if err != nil {
+		r.logger.Error("error marshalling strategies state", zap.Error(err))
+		return
+	}
+	if err = store.Save(data); err != nil {
+		r.logger.Error("error saving strategies state", zap.Error(err))
+	}
+}
+
+// Duration is a time.Duration marshalled as a string like "10m" in strategy parameters.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"10m\": %w", err)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
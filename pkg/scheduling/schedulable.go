@@ -1,6 +1,7 @@
 package scheduling
 
 import (
+	"context"
 	"fmt"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/promclient"
@@ -26,11 +27,12 @@ func NewSchedulableStrategy(kubeClient *Kubeclient, promClient *Promclient, logg
 		targets:     targets,
 		schedulable: schedulable,
 	}
-	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("schedulable", strategy.Reconcile, logger.With(zap.String("strategy", "schedulable")))
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("schedulable", strategy.Reconcile, logger.With(zap.String("strategy", "schedulable")),
+		Mutates(ResourceSchedulable))
 	return strategy
 }
 
-func (t *SchedulableStrategy) Reconcile() error {
+func (t *SchedulableStrategy) Reconcile(ctx context.Context) error {
 	// is there a node n where Schedulable = 1?
 	//	yes: is there a node n where diff > 0?
 	//	    yes: schedulable_n = 1; schedule()
@@ -48,8 +50,9 @@ func (t *SchedulableStrategy) Reconcile() error {
 		for _, v := range diffs {
 			if v.Data[0].Usage > 0 {
 				t.logger.Info("found node with diff > 0, setting it to Schedulable", zap.String("nodeName", v.NodeName))
-				t.schedulable[v.NodeName].Set(true)
-				break
+				if t.set(v.NodeName, true) {
+					break
+				}
 			}
 		}
 	} else {
@@ -58,13 +61,16 @@ func (t *SchedulableStrategy) Reconcile() error {
 		for _, currentDiff := range diffs {
 			if currentDiff.NodeName == schedulableNode && currentDiff.Data[0].Usage <= 0 {
 				t.logger.Info("currently Schedulable node has diff <= 0, picking another node", zap.String("nodeName", currentDiff.NodeName))
-				t.schedulable[currentDiff.NodeName].Set(false)
+				if !t.set(currentDiff.NodeName, false) {
+					continue
+				}
 				// Pick a node where diff > 0
 				for _, newNodeDiff := range diffs {
 					if newNodeDiff.Data[0].Usage > 0 {
 						t.logger.Info("found node with diff > 0, setting it to Schedulable", zap.String("nodeName", newNodeDiff.NodeName))
-						t.schedulable[newNodeDiff.NodeName].Set(true)
-						break
+						if t.set(newNodeDiff.NodeName, true) {
+							break
+						}
 					}
 				}
 			}
@@ -73,6 +79,18 @@ func (t *SchedulableStrategy) Reconcile() error {
 	return nil
 }
 
+// set sets whether the node is Schedulable, unless another strategy just changed it. It returns whether it was set.
+func (t *SchedulableStrategy) set(nodeName string, schedulable bool) bool {
+	release, ok := t.Acquire(nodeName, ResourceSchedulable)
+	if !ok {
+		return false
+	}
+	defer release()
+	t.schedulable[nodeName].Set(schedulable)
+	t.RecordAction()
+	return true
+}
+
 func (t *SchedulableStrategy) Stop() {
 	t.BaseConcurrentStrategy.Stop()
 	// Set all targets to 1
@@ -84,7 +102,7 @@ func (t *SchedulableStrategy) Stop() {
 // TODO: Remove duplicate in orchestration.go
 func (t *SchedulableStrategy) findSchedulableNode() string {
 	for k, v := range t.schedulable {
-		if v.Schedulable {
+		if v.IsSchedulable() {
 			return k
 		}
 	}
@@ -1,20 +1,43 @@
 package scheduling
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 	"git.helio.dev/eco-qube/target-exporter/pkg/promclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"math"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+var recommendedCpuLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "target_exporter_recommended_cpu_limit",
+	Help: "CPU limit, in cores, recommended for a pod by the self-driving strategy in recommend-only mode.",
+}, []string{"node", "pod"})
+
 const AdjustmentSlack = 2
 const TimeSinceInsertionThreshold = 1 * time.Minute
 const TimeSinceSchedulingThreshold = 1 * time.Minute
 
+const (
+	// SelfDrivingDiff adjusts the CPU limits by the averaged diff of the node split between its pods
+	SelfDrivingDiff = "diff"
+	// SelfDrivingPid adjusts the CPU limits by the output of a PID controller per node
+	SelfDrivingPid = "pid"
+
+	DefaultControllerSamplePeriod = 15 * time.Second
+	// DefaultMaxCpuLimit is the CPU limit up to which pods without max-cpu-limit annotation are relaxed
+	DefaultMaxCpuLimit = 100
+)
+
 type SkipItem struct {
 	PodName       string
 	InsertionTime time.Time
@@ -30,6 +53,40 @@ type SelfDrivingStrategy struct {
 	promClient *promclient.Promclient
 	targets    map[string]*Target
 	skipForNow SkipList
+
+	// mu protects the parameters, the controllers and the recommendations, the parameters can be changed while
+	// reconciling
+	mu              sync.Mutex
+	params          SelfDrivingParams
+	controllers     map[string]*PidController
+	recommendations map[string]CpuLimitRecommendation
+}
+
+// SelfDrivingParams are the parameters of the self-driving strategy that can be changed at runtime. The controller
+// parameters only apply in the pid mode, the CPU limits and the controller output are percentages of the node CPU.
+type SelfDrivingParams struct {
+	Mode string `json:"mode"`
+	// Gains are the gains of the nodes missing from NodeGains
+	Gains     PidGains            `json:"gains"`
+	NodeGains map[string]PidGains `json:"nodeGains"`
+	// IntegralLimit bounds the integral of the error, 0 for no bound
+	IntegralLimit float64 `json:"integralLimit"`
+	// MaxOutput bounds the change of the CPU limits of a node per sample period, 0 for no bound
+	MaxOutput float64 `json:"maxOutput"`
+	// MaxCpuLimit is the highest CPU limit of the pods without max-cpu-limit annotation
+	MaxCpuLimit  float64  `json:"maxCpuLimit"`
+	SamplePeriod Duration `json:"samplePeriod"`
+	// RecommendOnly annotates the pods with the CPU limits instead of patching them
+	RecommendOnly bool `json:"recommendOnly"`
+}
+
+// CpuLimitRecommendation is a CPU limit computed in recommend-only mode, but not applied.
+type CpuLimitRecommendation struct {
+	Pod                 string    `json:"pod"`
+	Node                string    `json:"node"`
+	CpuLimit            string    `json:"cpuLimit"`
+	RecommendedCpuLimit string    `json:"recommendedCpuLimit"`
+	Time                time.Time `json:"time"`
 }
 
 func NewSelfDrivingStrategy(kubeClient *kubeclient.Kubeclient, promClient *promclient.Promclient, logger *zap.Logger, targets map[string]*Target) *SelfDrivingStrategy {
@@ -38,21 +95,122 @@ func NewSelfDrivingStrategy(kubeClient *kubeclient.Kubeclient, promClient *promc
 		promClient: promClient,
 		targets:    targets,
 		skipForNow: make(SkipList, 0),
+		params: SelfDrivingParams{
+			Mode:          SelfDrivingDiff,
+			Gains:         PidGains{Kp: 0.5, Ki: 0.02},
+			NodeGains:     make(map[string]PidGains),
+			IntegralLimit: 500,
+			MaxOutput:     20,
+			MaxCpuLimit:   DefaultMaxCpuLimit,
+			SamplePeriod:  Duration(DefaultControllerSamplePeriod),
+		},
+		controllers:     make(map[string]*PidController),
+		recommendations: make(map[string]CpuLimitRecommendation),
 	}
-	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("selfDriving", strategy.Reconcile, logger.With(zap.String("strategy", "selfDriving")))
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("selfDriving", strategy.Reconcile, logger.With(zap.String("strategy", "selfDriving")),
+		Mutates(ResourcePodLimits))
 	return strategy
 }
 
+func (s *SelfDrivingStrategy) Parameters() interface{} {
+	return s.getParams()
+}
+
+// SetParameters updates the parameters, switching modes resets the controllers and leaving the recommend-only mode
+// forgets the recommendations and removes them from the pods.
+func (s *SelfDrivingStrategy) SetParameters(data []byte) error {
+	params := s.getParams()
+	if err := json.Unmarshal(data, &params); err != nil {
+		return err
+	}
+	if params.Mode != SelfDrivingDiff && params.Mode != SelfDrivingPid {
+		return fmt.Errorf("mode must be %s or %s", SelfDrivingDiff, SelfDrivingPid)
+	}
+	if params.IntegralLimit < 0 || params.MaxOutput < 0 || params.MaxCpuLimit <= 0 || params.SamplePeriod <= 0 {
+		return fmt.Errorf("integralLimit and maxOutput must not be negative, maxCpuLimit and samplePeriod must be positive")
+	}
+	s.mu.Lock()
+	if params.Mode != s.params.Mode {
+		s.controllers = make(map[string]*PidController)
+	}
+	leavingRecommendOnly := s.params.RecommendOnly && !params.RecommendOnly
+	if !params.RecommendOnly {
+		s.recommendations = make(map[string]CpuLimitRecommendation)
+		recommendedCpuLimit.Reset()
+	}
+	s.params = params
+	s.mu.Unlock()
+	if leavingRecommendOnly {
+		s.removeRecommendationAnnotations()
+	}
+	return nil
+}
+
+// removeRecommendationAnnotations removes the recommended CPU limit annotation from the pods, including those
+// annotated before a restart. Errors are logged.
+func (s *SelfDrivingStrategy) removeRecommendationAnnotations() {
+	pods, err := s.kubeClient.GetPodsInNamespace()
+	if err != nil {
+		s.logger.Error("error listing pods to remove the recommendations", zap.Error(err))
+		return
+	}
+	for _, pod := range pods {
+		if _, ok := pod.Annotations[kubeclient.RecommendedCpuLimitAnnotation]; !ok {
+			continue
+		}
+		if err = s.kubeClient.RemovePodAnnotation(pod.Name, kubeclient.RecommendedCpuLimitAnnotation); err != nil {
+			s.logger.Error("error removing the recommendation of a pod", zap.String("pod", pod.Name), zap.Error(err))
+		}
+	}
+}
+
+func (s *SelfDrivingStrategy) getParams() SelfDrivingParams {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	params := s.params
+	params.NodeGains = make(map[string]PidGains, len(s.params.NodeGains))
+	for nodeName, gains := range s.params.NodeGains {
+		params.NodeGains[nodeName] = gains
+	}
+	return params
+}
+
+// controller returns the controller of a node, created on first use, with the current gains and bounds.
+func (s *SelfDrivingStrategy) controller(nodeName string) *PidController {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	controller, ok := s.controllers[nodeName]
+	if !ok {
+		controller = &PidController{}
+		s.controllers[nodeName] = controller
+	}
+	controller.Gains = s.params.Gains
+	if gains, ok := s.params.NodeGains[nodeName]; ok {
+		controller.Gains = gains
+	}
+	controller.IntegralLimit = s.params.IntegralLimit
+	controller.MaxOutput = s.params.MaxOutput
+	return controller
+}
+
 // See https://www.notion.so/e6e3f42774a54824acdacf2bfc1811e4?v=2555eddf50e54d8e87e367fd6feb8f43&p=e3be92a033fe417ebf9560f298c3297f&pm=c
-func (s *SelfDrivingStrategy) Reconcile() error {
+func (s *SelfDrivingStrategy) Reconcile(ctx context.Context) error {
 	promClient := s.promClient
-	kubeClient := s.kubeClient
 	cpuCounts, err := promClient.GetCpuCounts()
 
 	diffs, err := promClient.GetCurrentCpuDiff()
 	if err != nil {
 		return err
 	}
+	params := s.getParams()
+	if params.RecommendOnly {
+		if err = s.pruneRecommendations(); err != nil {
+			return err
+		}
+	}
+	if params.Mode == SelfDrivingPid {
+		return s.reconcileController(cpuCounts, diffs)
+	}
 
 	for _, nodeDiff := range diffs {
 		avgDiff := promclient.GetAvgInstantUsage(nodeDiff.Data)
@@ -68,7 +226,7 @@ func (s *SelfDrivingStrategy) Reconcile() error {
 		if err != nil {
 			return err
 		}
-		pods, err := kubeClient.GetPodsInNamespaceByNode(nodeDiff.NodeName)
+		pods, err := s.kubeClient.GetPodsInNamespaceByNode(nodeDiff.NodeName)
 		if err != nil {
 			return err
 		}
@@ -81,7 +239,7 @@ func (s *SelfDrivingStrategy) Reconcile() error {
 			filteredPods = append(filteredPods, pod)
 		}
 
-		deltas, err := getViolatingPodsDelta(cpuCounts, nodeDiff, filteredPods)
+		deltas, err := getViolatingPodsDelta(cpuCounts, nodeDiff, filteredPods, params.MaxCpuLimit)
 		if err != nil {
 			s.logger.Error("failed to get violating pods delta", zap.Error(err))
 			return err
@@ -89,28 +247,175 @@ func (s *SelfDrivingStrategy) Reconcile() error {
 		for podName, deltaEntry := range deltas {
 			if deltaEntry.update != 0 {
 				// patch
-				delta, err := kubeclient.PercentageToResourceQuantity(cpuCounts, deltaEntry.update, deltaEntry.nodeName)
+				cpuLimit, err := kubeclient.PercentageToResourceQuantity(cpuCounts, deltaEntry.cpuLimit+deltaEntry.update, deltaEntry.nodeName)
 				if err != nil {
 					s.logger.Error("failed to convert resource quantity to percentage", zap.Error(err))
 					return err
 				}
-				cpuLimit := getPodFromName(filteredPods, podName).Spec.Containers[0].Resources.Limits.Cpu().DeepCopy()
-				if isNodeAboveTarget(avgDiff) {
-					cpuLimit.Sub(delta)
-					s.logger.Debug("node is below target", zap.String("node", deltaEntry.nodeName),
-						zap.String("pod", podName), zap.Float64("delta", deltaEntry.update), zap.String("newCpuLimit", cpuLimit.String()))
-				} else if isNodeBelowTarget(avgDiff) {
-					cpuLimit.Add(delta)
-					s.logger.Debug("node is above target", zap.String("node", deltaEntry.nodeName),
-						zap.String("pod", podName), zap.Float64("delta", deltaEntry.update), zap.String("newCpuLimit", cpuLimit.String()))
-				}
-				err = kubeClient.PatchCpuLimit(cpuLimit, podName)
+				s.logger.Debug("adjusting cpu limit", zap.String("node", deltaEntry.nodeName),
+					zap.String("pod", podName), zap.Float64("delta", deltaEntry.update), zap.String("newCpuLimit", cpuLimit.String()))
+				pod := *getPodFromName(filteredPods, podName)
+				ok, err := s.setCpuLimit(deltaEntry.nodeName, pod, cpuLimit, params.RecommendOnly)
 				if err != nil {
-					s.logger.Error("failed to patch cpu limit", zap.Error(err))
 					return err
 				}
-				s.addPodToSkipList(*getPodFromName(filteredPods, podName))
+				if ok {
+					s.addPodToSkipList(pod)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileController adjusts the CPU limits of the pods of each node by the output of its controller, once per sample
+// period. The error is the target of the node minus its averaged usage, the output is split between its pods by
+// priority like the diff, each new limit being clamped between the min-cpu-limit of the pod and its max-cpu-limit, or
+// MaxCpuLimit if not set. When the limits cannot follow the output, the controller does not integrate the error.
+func (s *SelfDrivingStrategy) reconcileController(cpuCounts map[string]int, diffs []promclient.NodeCpuUsage) error {
+	params := s.getParams()
+	now := time.Now()
+	for _, nodeDiff := range diffs {
+		nodeName := nodeDiff.NodeName
+		controller := s.controller(nodeName)
+		if !controller.Due(now, time.Duration(params.SamplePeriod)) {
+			continue
+		}
+		pods, err := s.kubeClient.GetPodsInNamespaceByNode(nodeName)
+		if err != nil {
+			return err
+		}
+		controlledPods := make([]v1.Pod, 0)
+		for _, pod := range pods {
+			if pod.Status.Phase != v1.PodRunning || strings.Contains(pod.Name, "telemetry-aware-scheduling") ||
+				getTimeSincePodScheduled(pod) < TimeSinceSchedulingThreshold {
+				continue
+			}
+			controlledPods = append(controlledPods, pod)
+		}
+		if len(controlledPods) == 0 {
+			controller.Reset()
+			continue
+		}
+
+		shares, err := getPodShares(cpuCounts, nodeName, controlledPods, params.MaxCpuLimit)
+		if err != nil {
+			return err
+		}
+		controlErr, output, updates := controlStep(controller, nodeDiff, shares, now)
+		controllerError.WithLabelValues(nodeName).Set(controlErr)
+		controllerOutput.WithLabelValues(nodeName).Set(output)
+
+		applied := 0.0
+		for _, share := range shares {
+			update, ok := updates[share.pod.Name]
+			if !ok {
+				continue
+			}
+			applied += math.Abs(update)
+			quantity, err := kubeclient.PercentageToResourceQuantity(cpuCounts, share.cpuLimit+update, nodeName)
+			if err != nil {
+				return err
+			}
+			if quantity.Cmp(*share.pod.Spec.Containers[0].Resources.Limits.Cpu()) == 0 {
+				continue
+			}
+			ok, err = s.setCpuLimit(nodeName, share.pod, quantity, params.RecommendOnly)
+			if err != nil {
+				return err
 			}
+			if ok {
+				s.logger.Debug("adjusted cpu limit", zap.String("node", nodeName), zap.String("pod", share.pod.Name),
+					zap.Float64("error", controlErr), zap.Float64("output", output), zap.String("newCpuLimit", quantity.String()))
+			}
+		}
+		// The limits do not follow the output when they are only recommended
+		saturated := applied < math.Abs(output)-1e-9 || params.RecommendOnly
+		if saturated {
+			controller.Saturated()
+		}
+	}
+	return nil
+}
+
+// controlStep updates the controller of a node and splits its output between the pods. The diff is the target minus
+// the usage, so the error is the headroom left to the pods: positive relaxes their limits, negative throttles them.
+func controlStep(controller *PidController, nodeDiff promclient.NodeCpuUsage, shares []podShare, now time.Time) (float64, float64, map[string]float64) {
+	controlErr := promclient.GetAvgInstantUsage(nodeDiff.Data)
+	output := controller.Update(controlErr, now)
+	return controlErr, output, distributeCpuDelta(output, shares)
+}
+
+// setCpuLimit patches the CPU limit of a pod or, in recommend-only mode, recommends it, and returns whether it did.
+func (s *SelfDrivingStrategy) setCpuLimit(nodeName string, pod v1.Pod, cpuLimit resource.Quantity, recommendOnly bool) (bool, error) {
+	if recommendOnly {
+		return true, s.recommend(nodeName, pod, cpuLimit)
+	}
+	release, ok := s.Acquire(nodeName, ResourcePodLimits)
+	if !ok {
+		return false, nil
+	}
+	err := s.kubeClient.PatchCpuLimit(cpuLimit, pod.Name)
+	release()
+	if err != nil {
+		s.logger.Error("failed to patch cpu limit", zap.Error(err))
+		return false, err
+	}
+	s.RecordAction()
+	return true, nil
+}
+
+// recommend writes the recommended CPU limit to the pod annotation and keeps it for the recommendations endpoint and
+// metric.
+func (s *SelfDrivingStrategy) recommend(nodeName string, pod v1.Pod, cpuLimit resource.Quantity) error {
+	if err := s.kubeClient.AnnotatePod(pod.Name, kubeclient.RecommendedCpuLimitAnnotation, cpuLimit.String()); err != nil {
+		return err
+	}
+	s.logger.Info("recommending cpu limit", zap.String("node", nodeName), zap.String("pod", pod.Name),
+		zap.String("cpuLimit", pod.Spec.Containers[0].Resources.Limits.Cpu().String()),
+		zap.String("recommendedCpuLimit", cpuLimit.String()))
+	recommendedCpuLimit.WithLabelValues(nodeName, pod.Name).Set(cpuLimit.AsApproximateFloat64())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recommendations[pod.Name] = CpuLimitRecommendation{
+		Pod:                 pod.Name,
+		Node:                nodeName,
+		CpuLimit:            pod.Spec.Containers[0].Resources.Limits.Cpu().String(),
+		RecommendedCpuLimit: cpuLimit.String(),
+		Time:                time.Now(),
+	}
+	return nil
+}
+
+// Recommendations returns the latest CPU limit recommended for each pod, sorted by node and pod.
+func (s *SelfDrivingStrategy) Recommendations() []CpuLimitRecommendation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recommendations := make([]CpuLimitRecommendation, 0, len(s.recommendations))
+	for _, recommendation := range s.recommendations {
+		recommendations = append(recommendations, recommendation)
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Node != recommendations[j].Node {
+			return recommendations[i].Node < recommendations[j].Node
+		}
+		return recommendations[i].Pod < recommendations[j].Pod
+	})
+	return recommendations
+}
+
+// pruneRecommendations forgets the recommendations of the pods that are gone or completed.
+func (s *SelfDrivingStrategy) pruneRecommendations() error {
+	pods, err := s.kubeClient.GetPodsInNamespace()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for podName, recommendation := range s.recommendations {
+		if pod := getPodFromName(pods, podName); pod == nil || isPodCompleted(pod) {
+			recommendedCpuLimit.DeleteLabelValues(recommendation.Node, podName)
+			delete(s.recommendations, podName)
 		}
 	}
 	return nil
@@ -166,7 +471,7 @@ func isNodeInViolation(avgDiff float64) bool {
 	return isNodeAboveTarget(avgDiff) || isNodeBelowTarget(avgDiff)
 }
 
-//func (s *SelfDrivingStrategy) Reconcile() error {
+//func (s *SelfDrivingStrategy) Reconcile(ctx context.Context) error {
 //	// Get current cpu diffs
 //	promClient := s.promClient
 //	kubeClient := s.kubeClient
@@ -320,85 +625,150 @@ func isNodeBelowTarget(avgDiff float64) bool {
 	return avgDiff < -AdjustmentSlack
 }
 
-// Values can also be 0. Negative values mean that the pod needs to be throttled, positive values mean that the pod CPU limit can be increased.
-func getViolatingPodsDelta(cpuCounts map[string]int, diffs promclient.NodeCpuUsage, violatingPods []v1.Pod) (map[string]struct {
+// podDelta is the change of the CPU limit of a pod, the limits are percentages of the node CPU.
+type podDelta struct {
 	update   float64
+	cpuLimit float64
 	nodeName string
-}, error) {
-	updates := make(map[string]struct {
-		update   float64
-		nodeName string
-	})
-	// If node diff is >= 0, return simple average because the adjustment will be surely not subceed min cpu of job
-	// For each pod p in pods
-	//		delta := min_cpu(p) - |simple_delta|
-	//  	if delta < 0:
-	//  		subceeding_count += 1;
-	// 			map[name(p)] = cpu_limit(p) - min_cpu(p);
-	//			ignore_partial += cpu_limit(p) - min_cpu(p);
-	//		else:
-	// 		 	not_subceeding = append(not_subceeding, p)
-	// For each pod p in not_subceeding
-	// 		map[name(p)] = (avg_diff(N) - ignore_partial) / (len(P) - subceeding_count)
-	// For each k, v in map:
-	//      patch(k, v)
-
-	// For each violating pod, compute its own delta and keep track of: count of "specials" and sum of "special delta"
-	// Recompute the delta excluding len(specials) and subtracting "special delta"
-	// Now we have a delta for each node not subceeding which will be evenly distributed, and a lesser delta for each node
-	// that would have its delta subceeding its min_job.
-	avgNodeDiff := promclient.GetAvgInstantUsage(diffs.Data)
-	if avgNodeDiff >= 0 {
-		// Simple average, no need to take into consideration min. This is because when we relax pod limits we don't
-		// have to check if the adjustment goes below the min cpu as the difference is never negative (i.e. throttling)
-		simpleDelta := math.Abs(avgNodeDiff) / float64(len(violatingPods))
-		for _, pod := range violatingPods {
-			updates[pod.Name] = struct {
-				update   float64
-				nodeName string
-			}{update: simpleDelta, nodeName: diffs.NodeName}
-		}
-		return updates, nil
-	}
-	// In that case, we need to throttle some pods
-	subceedingCount := 0
-	ignorePartials := 0.0
-	notSubceeding := make([]v1.Pod, 0)
-
-	// Build a map of pod name to new cpu limit
-	for _, pod := range violatingPods {
-		minPodCpu, err := kubeclient.GetMinCpu(pod)
+}
+
+// Values can also be 0. Negative values mean that the pod needs to be throttled, positive values mean that the pod CPU limit can be increased.
+// The node diff is split by priority and weight, see distributeCpuDelta, the pods without max-cpu-limit annotation can
+// be relaxed up to maxCpuLimit.
+func getViolatingPodsDelta(cpuCounts map[string]int, diffs promclient.NodeCpuUsage, violatingPods []v1.Pod, maxCpuLimit float64) (map[string]podDelta, error) {
+	shares, err := getPodShares(cpuCounts, diffs.NodeName, violatingPods, maxCpuLimit)
+	if err != nil {
+		return nil, err
+	}
+	// The diff is the target minus the usage: a node above its target (negative diff) needs its pods to be throttled
+	// by the diff, one with headroom (positive diff) has them relaxed
+	updates := distributeCpuDelta(promclient.GetAvgInstantUsage(diffs.Data), shares)
+	deltas := make(map[string]podDelta)
+	for _, share := range shares {
+		deltas[share.pod.Name] = podDelta{
+			update:   updates[share.pod.Name],
+			cpuLimit: share.cpuLimit,
+			nodeName: diffs.NodeName,
+		}
+	}
+	return deltas, nil
+}
+
+// podShare is a pod taking part in the change of the CPU limits of its node, within its min and max CPU limits.
+type podShare struct {
+	pod         v1.Pod
+	cpuLimit    float64
+	minCpuLimit float64
+	maxCpuLimit float64
+	priority    int
+	weight      float64
+}
+
+// getPodShares reads the CPU limit and the annotations of the pods. A pod without min-cpu-limit annotation is never
+// throttled, one without max-cpu-limit annotation is relaxed up to defaultMaxCpuLimit.
+func getPodShares(cpuCounts map[string]int, nodeName string, pods []v1.Pod, defaultMaxCpuLimit float64) ([]podShare, error) {
+	shares := make([]podShare, 0, len(pods))
+	for _, pod := range pods {
+		cpuLimit, err := kubeclient.ResourceQuantityToPercentage(cpuCounts, *pod.Spec.Containers[0].Resources.Limits.Cpu(), nodeName)
 		if err != nil {
-			if err.Error() == "job min annotation not found" {
-				continue
+			return nil, err
+		}
+		minCpuLimit, err := kubeclient.GetMinCpu(pod)
+		if err != nil {
+			if err.Error() != "job min annotation not found" {
+				return nil, err
 			}
+			minCpuLimit = cpuLimit
+		}
+		maxCpuLimit, err := kubeclient.GetMaxCpu(pod)
+		if err != nil {
 			return nil, err
 		}
-		podCpuLimitQuantity := pod.Spec.Containers[0].Resources.Limits.Cpu()
-		podCpuLimit, err := kubeclient.ResourceQuantityToPercentage(cpuCounts, *podCpuLimitQuantity, diffs.NodeName)
-		delta := minPodCpu - math.Abs(avgNodeDiff)
-		if delta < 0 {
-			delta = podCpuLimit - minPodCpu
-			updates[pod.Name] = struct {
-				update   float64
-				nodeName string
-			}{update: delta, nodeName: diffs.NodeName}
-			ignorePartials += delta
-			subceedingCount += 1
-		} else {
-			notSubceeding = append(notSubceeding, pod)
-		}
-	}
-	// Deal with pods that have not their cpu limit subceeding their minimum cpu
-	for _, pod := range notSubceeding {
-		updates[pod.Name] = struct {
-			update   float64
-			nodeName string
-		}{
-			update:   (avgNodeDiff - ignorePartials) / (float64(len(violatingPods) - subceedingCount)),
-			nodeName: diffs.NodeName,
+		if maxCpuLimit <= 0 {
+			maxCpuLimit = defaultMaxCpuLimit
+		}
+		priority, err := kubeclient.GetPriority(pod)
+		if err != nil {
+			return nil, err
 		}
+		weight, err := kubeclient.GetWeight(pod)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, podShare{
+			pod:         pod,
+			cpuLimit:    cpuLimit,
+			minCpuLimit: minCpuLimit,
+			maxCpuLimit: maxCpuLimit,
+			priority:    priority,
+			weight:      weight,
+		})
 	}
+	return shares, nil
+}
 
-	return updates, nil
+// distributeCpuDelta splits the change of the CPU limits of a node between its pods and returns the change of each
+// pod. Throttling (negative delta) goes through the pods by increasing priority and relaxing by decreasing priority:
+// the pods of a priority take the whole delta if they can, each a part proportional to its weight within its min and
+// max CPU limits, and the next priority takes the rest. The changes sum up to less than delta when the limits cannot follow.
+func distributeCpuDelta(delta float64, shares []podShare) map[string]float64 {
+	throttle := delta < 0
+	sorted := make([]podShare, len(shares))
+	copy(sorted, shares)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if throttle {
+			return sorted[i].priority < sorted[j].priority
+		}
+		return sorted[i].priority > sorted[j].priority
+	})
+	updates := make(map[string]float64)
+	remaining := math.Abs(delta)
+	for i := 0; i < len(sorted) && remaining > 0; {
+		j := i
+		for j < len(sorted) && sorted[j].priority == sorted[i].priority {
+			j++
+		}
+		remaining -= splitByWeight(sorted[i:j], remaining, throttle, updates)
+		i = j
+	}
+	return updates
+}
+
+// splitByWeight splits amount between the pods in proportion to their weight, the part a pod cannot take going to the
+// others, and returns how much was taken.
+func splitByWeight(shares []podShare, amount float64, throttle bool, updates map[string]float64) float64 {
+	sign := 1.0
+	headroom := make(map[string]float64)
+	weights := make(map[string]float64)
+	for _, share := range shares {
+		weights[share.pod.Name] = share.weight
+		room := share.maxCpuLimit - share.cpuLimit
+		if throttle {
+			sign = -1
+			room = share.cpuLimit - share.minCpuLimit
+		}
+		if room > 0 {
+			headroom[share.pod.Name] = room
+		}
+	}
+	taken := 0.0
+	// Each round either gives every pod its part or fills at least one pod
+	for len(headroom) > 0 && amount-taken > 1e-9 {
+		totalWeight := 0.0
+		for podName := range headroom {
+			totalWeight += weights[podName]
+		}
+		left := amount - taken
+		for podName, room := range headroom {
+			take := math.Min(left*weights[podName]/totalWeight, room)
+			updates[podName] += sign * take
+			taken += take
+			if take < room {
+				headroom[podName] = room - take
+			} else {
+				delete(headroom, podName)
+			}
+		}
+	}
+	return taken
 }
@@ -0,0 +1,109 @@
+package scheduling
+
+import (
+	"testing"
+)
+
+func TestDistributeCpuDelta(t *testing.T) {
+	tests := []struct {
+		name   string
+		delta  float64
+		shares []podShare
+		want   map[string]float64
+	}{
+		{
+			name:   "relax evenly",
+			delta:  10,
+			shares: []podShare{testShare("a", 20, 10, 100, 0, 1), testShare("b", 20, 10, 100, 0, 1)},
+			want:   map[string]float64{"a": 5, "b": 5},
+		},
+		{
+			name:   "throttle evenly",
+			delta:  -10,
+			shares: []podShare{testShare("a", 20, 10, 100, 0, 1), testShare("b", 20, 10, 100, 0, 1)},
+			want:   map[string]float64{"a": -5, "b": -5},
+		},
+		{
+			name:   "throttle lowest priority first",
+			delta:  -10,
+			shares: []podShare{testShare("low", 30, 10, 100, 0, 1), testShare("high", 30, 10, 100, 5, 1)},
+			want:   map[string]float64{"low": -10},
+		},
+		{
+			name:   "throttle next priority once lowest is at its min",
+			delta:  -10,
+			shares: []podShare{testShare("low", 14, 10, 100, 0, 1), testShare("high", 30, 10, 100, 5, 1)},
+			want:   map[string]float64{"low": -4, "high": -6},
+		},
+		{
+			name:   "relax highest priority first",
+			delta:  10,
+			shares: []podShare{testShare("low", 30, 10, 100, 0, 1), testShare("high", 30, 10, 100, 5, 1)},
+			want:   map[string]float64{"high": 10},
+		},
+		{
+			name:   "relax next priority once highest is at its max",
+			delta:  10,
+			shares: []podShare{testShare("low", 30, 10, 100, 0, 1), testShare("high", 33, 10, 35, 5, 1)},
+			want:   map[string]float64{"high": 2, "low": 8},
+		},
+		{
+			name:   "split by weight",
+			delta:  -12,
+			shares: []podShare{testShare("a", 50, 10, 100, 0, 1), testShare("b", 50, 10, 100, 0, 3)},
+			want:   map[string]float64{"a": -3, "b": -9},
+		},
+		{
+			name:   "part of a clamped pod goes to the others by weight",
+			delta:  12,
+			shares: []podShare{testShare("a", 50, 10, 51, 0, 2), testShare("b", 50, 10, 100, 0, 1), testShare("c", 50, 10, 100, 0, 1)},
+			want:   map[string]float64{"a": 1, "b": 5.5, "c": 5.5},
+		},
+		{
+			name:   "limits cannot follow the whole delta",
+			delta:  -30,
+			shares: []podShare{testShare("a", 20, 10, 100, 0, 1), testShare("b", 20, 15, 100, 0, 1)},
+			want:   map[string]float64{"a": -10, "b": -5},
+		},
+		{
+			name:   "pod without room is left out",
+			delta:  -10,
+			shares: []podShare{testShare("a", 20, 20, 100, 0, 1), testShare("b", 20, 10, 100, 0, 1)},
+			want:   map[string]float64{"b": -10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := distributeCpuDelta(tt.delta, tt.shares)
+			if len(got) != len(tt.want) {
+				t.Fatalf("updates = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if !almostEqual(got[name], want) {
+					t.Fatalf("updates = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitByWeight(t *testing.T) {
+	shares := []podShare{testShare("a", 50, 40, 60, 0, 1), testShare("b", 50, 0, 100, 0, 4)}
+	updates := make(map[string]float64)
+	// a takes 1/5 of 20 = 4, b 16
+	if taken := splitByWeight(shares, 20, false, updates); !almostEqual(taken, 20) {
+		t.Fatalf("taken = %f, want 20", taken)
+	}
+	if !almostEqual(updates["a"], 4) || !almostEqual(updates["b"], 16) {
+		t.Fatalf("updates = %v, want a: 4, b: 16", updates)
+	}
+
+	// a can only be throttled by 10, down to its min
+	updates = make(map[string]float64)
+	if taken := splitByWeight(shares, 100, true, updates); !almostEqual(taken, 60) {
+		t.Fatalf("taken = %f, want 60", taken)
+	}
+	if !almostEqual(updates["a"], -10) || !almostEqual(updates["b"], -50) {
+		t.Fatalf("updates = %v, want a: -10, b: -50", updates)
+	}
+}
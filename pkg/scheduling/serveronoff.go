@@ -1,67 +1,223 @@
 package scheduling
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"go.uber.org/zap"
+	"sort"
+	"sync"
 	"time"
 )
+import . "git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 import . "git.helio.dev/eco-qube/target-exporter/pkg/promclient"
 import . "git.helio.dev/eco-qube/target-exporter/pkg/serverswitch"
 
 const AvgTimeUsageMins = 5 // in minutes
 const MinAvgToTurnOff = 8  // in percentage
 
+const (
+	ServerOnOffInterval = 30 * time.Second
+	// ServerCooldown is the minimum time between two power changes of the same server
+	ServerCooldown    = 5 * time.Minute
+	DrainTimeout      = 10 * time.Minute
+	PowerStateTimeout = 5 * time.Minute
+
+	DefaultBootTimeout = 10 * time.Minute
+	DefaultMinOnTime   = 15 * time.Minute
+	// BootFailureBackoff is how long a server that failed to boot is not considered for power on
+	BootFailureBackoff = 30 * time.Minute
+)
+
+type ServerPowerState string
+
+const (
+	ServerOn       ServerPowerState = "on"
+	ServerDraining ServerPowerState = "draining" // cordoned, pods being evicted, then powered off
+	ServerOff      ServerPowerState = "off"
+	ServerBooting  ServerPowerState = "booting" // powered on, waiting for the node to be Ready
+)
+
+type ServerOnOffOption func(*ServerOnOffStrategy)
+
+// BootTimeout sets how long a server has to boot and its node to become Ready before it is considered failed.
+func BootTimeout(timeout time.Duration) ServerOnOffOption {
+	return func(t *ServerOnOffStrategy) {
+		t.bootTimeout = timeout
+	}
+}
+
+// MinOnTime sets how long a server is kept on after being powered on.
+func MinOnTime(minOnTime time.Duration) ServerOnOffOption {
+	return func(t *ServerOnOffStrategy) {
+		t.minOnTime = minOnTime
+	}
+}
+
+// Efficiency sets the energy efficiency score of the servers by node name (e.g. cores per watt), the most efficient
+// powered off server is turned on first.
+func Efficiency(efficiency map[string]float64) ServerOnOffOption {
+	return func(t *ServerOnOffStrategy) {
+		t.efficiency = efficiency
+	}
+}
+
+// ServerOnOffStrategy turns off servers whose average usage is low, after cordoning and draining their node, and
+// turns them back on when there is demand, i.e. pending pods, queued workloads or rising targets, that the powered
+// on nodes cannot take.
 type ServerOnOffStrategy struct {
 	*BaseConcurrentStrategy
 
-	serverSwitches map[string]*IpmiServerSwitch
-	promClient     *Promclient
-	logger         *zap.Logger
-	waitList       map[string]time.Time
+	bmcPool     *Pool
+	kubeClient  *Kubeclient
+	promClient  *Promclient
+	targets     map[string]*Target
+	schedulable map[string]*Schedulable
+	queue       *WorkloadQueue
+	efficiency  map[string]float64
+	bootTimeout time.Duration
+	minOnTime   time.Duration
+	logger      *zap.Logger
+
+	// transitions tracks the servers being powered on or off, they are waited for when the strategy stops
+	transitions sync.WaitGroup
+
+	mu          sync.Mutex
+	states      map[string]ServerPowerState
+	waitList    map[string]time.Time
+	poweredOnAt map[string]time.Time
+	lastTargets map[string]float64
 }
 
-func NewServerOnOffStrategy(serverSwitches map[string]*IpmiServerSwitch, promClient *Promclient, logger *zap.Logger) *ServerOnOffStrategy {
+func NewServerOnOffStrategy(bmcPool *Pool, kubeClient *Kubeclient, promClient *Promclient,
+	targets map[string]*Target, schedulable map[string]*Schedulable, logger *zap.Logger, options ...ServerOnOffOption) *ServerOnOffStrategy {
 	strategy := &ServerOnOffStrategy{
-		serverSwitches: serverSwitches,
-		promClient:     promClient,
-		logger:         logger,
-		waitList:       make(map[string]time.Time),
+		bmcPool:     bmcPool,
+		kubeClient:  kubeClient,
+		promClient:  promClient,
+		targets:     targets,
+		schedulable: schedulable,
+		logger:      logger,
+		states:      make(map[string]ServerPowerState),
+		waitList:    make(map[string]time.Time),
+		poweredOnAt: make(map[string]time.Time),
+		lastTargets: make(map[string]float64),
+		efficiency:  make(map[string]float64),
+		bootTimeout: DefaultBootTimeout,
+		minOnTime:   DefaultMinOnTime,
+	}
+	for _, option := range options {
+		option(strategy)
 	}
-	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("serveronoff", strategy.Reconcile, logger.With(zap.String("strategy", "serveronoff")))
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("serverOnOff", strategy.Reconcile,
+		logger.With(zap.String("strategy", "serverOnOff")), Interval(ServerOnOffInterval),
+		Mutates(ResourceNodePower, ResourceSchedulable))
 	return strategy
 }
 
-func (t *ServerOnOffStrategy) Reconcile() error {
+// ServerOnOffParams are the parameters of the server on/off strategy that can be changed at runtime.
+type ServerOnOffParams struct {
+	BootTimeout Duration           `json:"bootTimeout"`
+	MinOnTime   Duration           `json:"minOnTime"`
+	Efficiency  map[string]float64 `json:"efficiency"`
+}
+
+func (t *ServerOnOffStrategy) Parameters() interface{} {
+	return t.params()
+}
+
+func (t *ServerOnOffStrategy) SetParameters(data []byte) error {
+	params := t.params()
+	if err := json.Unmarshal(data, &params); err != nil {
+		return err
+	}
+	if params.BootTimeout <= 0 || params.MinOnTime < 0 {
+		return fmt.Errorf("bootTimeout must be positive and minOnTime must not be negative")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bootTimeout = time.Duration(params.BootTimeout)
+	t.minOnTime = time.Duration(params.MinOnTime)
+	t.efficiency = params.Efficiency
+	return nil
+}
+
+func (t *ServerOnOffStrategy) params() ServerOnOffParams {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	efficiency := make(map[string]float64, len(t.efficiency))
+	for nodeName, score := range t.efficiency {
+		efficiency[nodeName] = score
+	}
+	return ServerOnOffParams{
+		BootTimeout: Duration(t.bootTimeout),
+		MinOnTime:   Duration(t.minOnTime),
+		Efficiency:  efficiency,
+	}
+}
+
+func (t *ServerOnOffStrategy) Reconcile(ctx context.Context) error {
+	t.refreshStates()
+	if t.hasDemand() {
+		if t.hasRoomOnPoweredOnNodes() {
+			t.logger.Debug("demand can be served by powered on nodes")
+			return nil
+		}
+		// The server booting will take the demand, if it can, once it is on
+		if t.inState(ServerBooting) {
+			t.logger.Debug("a server is already booting")
+			return nil
+		}
+		if nodeName := t.pickServerToPowerOn(); nodeName != "" {
+			end, ok := t.Begin(nodeName, ResourceNodePower)
+			if !ok {
+				t.setState(nodeName, ServerOff)
+				return nil
+			}
+			t.RecordAction()
+			t.transitions.Add(1)
+			go func() {
+				defer t.transitions.Done()
+				defer end()
+				t.powerOn(ctx, nodeName)
+			}()
+		}
+		return nil
+	}
+
+	// Turn off one server at a time
+	if t.inState(ServerDraining) {
+		t.logger.Debug("a server is already being turned off")
+		return nil
+	}
 	avgUsages, err := t.promClient.GetAvgCpuUsages(AvgTimeUsageMins)
 	if err != nil {
 		t.logger.Error("error getting avg cpu usages", zap.Error(err))
 		return err
 	}
-	// Check if server is on
 	for _, currentAvgUsage := range avgUsages {
-		var isOn bool
-		srvSwitch := t.serverSwitches[currentAvgUsage.NodeName]
-		if isOn, err = t.serverSwitches[currentAvgUsage.NodeName].IsServerOn(); err != nil {
-			t.logger.Error("error checking if server is on, retrying", zap.Error(err), zap.String("server", srvSwitch.GetBmcEndpoint()))
-			retryServerConn(srvSwitch, t.logger)
-		}
-		t.logger.Info("checked if server is on", zap.Bool("isOn", isOn), zap.String("server", srvSwitch.GetBmcEndpoint()))
-		//if isOn && (t.waitList[currentAvgUsage.NodeName].Before(time.Now()) || t.waitList[currentAvgUsage.NodeName].IsZero()) {
-		//	if currentAvgUsage.Data < MinAvgToTurnOff {
-		//		// Server is below min required avg usage to keep it switched on, turn off
-		//		t.logger.Info("turning off server", zap.String("server", srvSwitch.GetBmcEndpoint()))
-		//		if err = srvSwitch.PowerOff(); err != nil {
-		//			t.logger.Error("error turning off server", zap.Error(err), zap.String("server", srvSwitch.GetBmcEndpoint()))
-		//			// TODO: Can mess up things if the retry fails for a long time, so we assume a stable connection atm
-		//			retryServerConn(srvSwitch, t.logger)
-		//		} else {
-		//			t.logger.Info("turned off server successfully", zap.String("server", srvSwitch.GetBmcEndpoint()))
-		//			// We need to allow for the server to fully shutdown
-		//			t.waitList[currentAvgUsage.NodeName] = time.Now().Add(1 * time.Minute)
-		//		}
-		//	}
-		//}
+		if currentAvgUsage.Data >= MinAvgToTurnOff || !t.canPowerOff(currentAvgUsage.NodeName) {
+			continue
+		}
+		// Server is below min required avg usage to keep it switched on, turn off one server at a time
+		nodeName := currentAvgUsage.NodeName
+		end, ok := t.Begin(nodeName, ResourceNodePower)
+		if !ok {
+			continue
+		}
+		t.logger.Info("server below min avg usage, turning it off", zap.String("nodeName", nodeName),
+			zap.Float64("avgUsage", currentAvgUsage.Data))
+		t.setState(nodeName, ServerDraining)
+		t.RecordAction()
+		t.transitions.Add(1)
+		go func() {
+			defer t.transitions.Done()
+			defer end()
+			t.powerOff(ctx, nodeName)
+		}()
+		break
 	}
-
 	return nil
 }
 
@@ -69,19 +225,352 @@ func (t *ServerOnOffStrategy) Start() {
 	t.BaseConcurrentStrategy.Start()
 }
 
+// Stop stops the strategy, see Halt.
 func (t *ServerOnOffStrategy) Stop() {
-	t.BaseConcurrentStrategy.Stop()
+	t.Halt()
 }
 
-func retryServerConn(srvSwitch *IpmiServerSwitch, logger *zap.Logger) {
-	delay := 5 * time.Second
-	for {
-		err := srvSwitch.RetryConn()
+// Halt stops the strategy and waits for the servers being powered on or off: their transition is cancelled and the
+// node uncordoned, unless the server was already powered off.
+func (t *ServerOnOffStrategy) Halt() {
+	t.BaseConcurrentStrategy.Halt()
+	t.transitions.Wait()
+}
+
+// WatchQueue makes queued workloads count as demand for powering servers on.
+func (t *ServerOnOffStrategy) WatchQueue(queue *WorkloadQueue) {
+	t.queue = queue
+}
+
+// BmcStatuses returns the health of the connection to every BMC.
+func (t *ServerOnOffStrategy) BmcStatuses() []BmcStatus {
+	return t.bmcPool.Statuses()
+}
+
+// States returns the power state of every server.
+func (t *ServerOnOffStrategy) States() map[string]ServerPowerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := make(map[string]ServerPowerState)
+	for k, v := range t.states {
+		states[k] = v
+	}
+	return states
+}
+
+// refreshStates reads the power state of the servers that are not transitioning. Servers whose BMC is unhealthy are
+// skipped, keeping their last known state, while the pool reconnects them.
+func (t *ServerOnOffStrategy) refreshStates() {
+	for _, nodeName := range t.bmcPool.NodeNames() {
+		if state := t.getState(nodeName); state == ServerDraining || state == ServerBooting {
+			continue
+		}
+		srvSwitch, healthy := t.bmcPool.Get(nodeName)
+		if !healthy {
+			t.logger.Debug("bmc unhealthy, skipping server", zap.String("nodeName", nodeName))
+			continue
+		}
+		isOn, err := srvSwitch.IsServerOn()
 		if err != nil {
-			logger.Error("failed to retry connection", zap.Error(err), zap.String("server", srvSwitch.GetBmcEndpoint()))
-			time.Sleep(delay)
+			t.logger.Error("error checking if server is on", zap.Error(err), zap.String("server", srvSwitch.GetBmcEndpoint()))
+			t.bmcPool.ReportFailure(nodeName, err)
+			continue
+		}
+		if isOn {
+			t.setState(nodeName, ServerOn)
 		} else {
-			break
+			t.setState(nodeName, ServerOff)
+		}
+	}
+}
+
+// hasDemand returns whether there are pods or workloads waiting to be scheduled or whether any target was raised
+// since the last check.
+func (t *ServerOnOffStrategy) hasDemand() bool {
+	demand := false
+	if t.queue != nil {
+		if eligible := t.queue.Eligible(); len(eligible) > 0 {
+			t.logger.Debug("queued workloads found", zap.Int("count", len(eligible)))
+			demand = true
+		}
+	}
+	pendingPods, err := t.kubeClient.GetPendingPods()
+	if err != nil {
+		t.logger.Error("error getting pending pods", zap.Error(err))
+	} else if len(pendingPods) > 0 {
+		t.logger.Debug("pending pods found", zap.Int("count", len(pendingPods)))
+		demand = true
+	}
+	for nodeName, target := range t.targets {
+		current := target.GetTarget()
+		if last, ok := t.lastTargets[nodeName]; ok && current > last {
+			t.logger.Debug("target raised", zap.String("nodeName", nodeName), zap.Float64("target", current))
+			demand = true
 		}
+		t.lastTargets[nodeName] = current
 	}
+	return demand
+}
+
+// hasRoomOnPoweredOnNodes returns whether any powered on node has a positive CPU diff. Nodes without a server switch
+// are always on.
+func (t *ServerOnOffStrategy) hasRoomOnPoweredOnNodes() bool {
+	diffs, err := t.promClient.GetCurrentCpuDiff()
+	if err != nil {
+		t.logger.Error("error getting cpu diff", zap.Error(err))
+		// Without diffs, assume there is room rather than powering servers on
+		return true
+	}
+	for _, diff := range diffs {
+		if len(diff.Data) == 0 || diff.Data[0].Usage <= 0 {
+			continue
+		}
+		if !t.bmcPool.Has(diff.NodeName) || t.getState(diff.NodeName) == ServerOn {
+			return true
+		}
+	}
+	return false
+}
+
+// pickServerToPowerOn returns the most energy efficient powered off server out of its cooldown, if any.
+func (t *ServerOnOffStrategy) pickServerToPowerOn() string {
+	nodeNames := make([]string, 0)
+	for _, nodeName := range t.bmcPool.NodeNames() {
+		if _, healthy := t.bmcPool.Get(nodeName); !healthy {
+			continue
+		}
+		if t.getState(nodeName) == ServerOff && !t.isCoolingDown(nodeName) {
+			nodeNames = append(nodeNames, nodeName)
+		}
+	}
+	if len(nodeNames) == 0 {
+		t.logger.Debug("no powered off server available to turn on")
+		return ""
+	}
+	efficiency := t.params().Efficiency
+	sort.Slice(nodeNames, func(i, j int) bool {
+		if efficiency[nodeNames[i]] != efficiency[nodeNames[j]] {
+			return efficiency[nodeNames[i]] > efficiency[nodeNames[j]]
+		}
+		return nodeNames[i] < nodeNames[j]
+	})
+	t.setState(nodeNames[0], ServerBooting)
+	return nodeNames[0]
+}
+
+// canPowerOff returns whether the server is on, out of its cooldown and minimum on time and not the last one powered
+// on.
+func (t *ServerOnOffStrategy) canPowerOff(nodeName string) bool {
+	if _, healthy := t.bmcPool.Get(nodeName); !healthy {
+		return false
+	}
+	if t.getState(nodeName) != ServerOn || t.isCoolingDown(nodeName) {
+		return false
+	}
+	t.mu.Lock()
+	poweredOnAt := t.poweredOnAt[nodeName]
+	minOnTime := t.minOnTime
+	t.mu.Unlock()
+	if time.Since(poweredOnAt) < minOnTime {
+		return false
+	}
+	on := 0
+	for _, state := range t.States() {
+		if state == ServerOn {
+			on++
+		}
+	}
+	return on > 1
+}
+
+// powerOff cordons the node, evicts its pods and powers the server off. If anything fails before the server is
+// powered off the node is uncordoned. The node power is kept in the arbiter by the caller for the whole transition,
+// and the schedulable resource from the cordon on. Once ctx is done, e.g. the strategy stopped, the node is uncordoned
+// unless the server is already shutting down.
+func (t *ServerOnOffStrategy) powerOff(ctx context.Context, nodeName string) {
+	srvSwitch, healthy := t.bmcPool.Get(nodeName)
+	if !healthy {
+		t.logger.Warn("bmc unhealthy, not turning off server", zap.String("nodeName", nodeName))
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	logger := t.logger.With(zap.String("nodeName", nodeName), zap.String("server", srvSwitch.GetBmcEndpoint()))
+	// The node is kept unschedulable from the cordon until the server is off or uncordoned
+	endCordon, ok := t.Begin(nodeName, ResourceSchedulable)
+	if !ok {
+		logger.Info("node schedulable recently changed by another strategy, not turning off server")
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	defer endCordon()
+	defer t.cooldown(nodeName)
+
+	if err := t.kubeClient.CordonNode(nodeName); err != nil {
+		logger.Error("error cordoning node", zap.Error(err))
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	if schedulable, ok := t.schedulable[nodeName]; ok {
+		schedulable.Cordon()
+	}
+	if err := t.kubeClient.DrainNode(ctx, nodeName, DrainTimeout); err != nil {
+		logger.Error("error draining node, uncordoning it", zap.Error(err))
+		t.uncordon(nodeName)
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	if ctx.Err() != nil {
+		logger.Info("strategy stopped, uncordoning node")
+		t.uncordon(nodeName)
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	logger.Info("turning off server")
+	if err := srvSwitch.PowerOff(); err != nil {
+		logger.Error("error turning off server, uncordoning node", zap.Error(err))
+		t.bmcPool.ReportFailure(nodeName, err)
+		t.uncordon(nodeName)
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	if err := WaitForPowerState(ctx, srvSwitch, false, PowerStateTimeout, 0); err != nil {
+		if ctx.Err() != nil {
+			// The server is shutting down, its power state is read again at the next reconcile
+			logger.Info("strategy stopped while waiting for the server to shut down")
+			t.setState(nodeName, ServerOff)
+			return
+		}
+		logger.Warn("server did not shut down gracefully, forcing it off", zap.Error(err))
+		if err = srvSwitch.ForceOff(); err != nil {
+			logger.Error("error forcing off server, uncordoning node", zap.Error(err))
+			t.bmcPool.ReportFailure(nodeName, err)
+			t.uncordon(nodeName)
+			// The power state will be read again at the next reconcile
+			t.setState(nodeName, ServerOn)
+			return
+		}
+	}
+	logger.Info("turned off server successfully")
+	t.setState(nodeName, ServerOff)
+}
+
+// powerOn powers the server on, waits for the node to be Ready and uncordons it. A server that does not boot in time
+// is forced off and left aside for BootFailureBackoff, so that another server can be tried.
+func (t *ServerOnOffStrategy) powerOn(ctx context.Context, nodeName string) {
+	srvSwitch, healthy := t.bmcPool.Get(nodeName)
+	if !healthy {
+		t.logger.Warn("bmc unhealthy, not turning on server", zap.String("nodeName", nodeName))
+		t.setState(nodeName, ServerOff)
+		return
+	}
+	logger := t.logger.With(zap.String("nodeName", nodeName), zap.String("server", srvSwitch.GetBmcEndpoint()))
+	defer t.cooldown(nodeName)
+
+	logger.Info("turning on server")
+	if err := srvSwitch.PowerOn(); err != nil {
+		logger.Error("error turning on server", zap.Error(err))
+		t.bmcPool.ReportFailure(nodeName, err)
+		t.setState(nodeName, ServerOff)
+		return
+	}
+	bootTimeout := time.Duration(t.params().BootTimeout)
+	err := WaitForPowerState(ctx, srvSwitch, true, bootTimeout, 0)
+	if err == nil {
+		err = t.waitForNodeReady(ctx, nodeName, bootTimeout)
+	}
+	if ctx.Err() != nil {
+		// The server is booting, its node is uncordoned so that it is schedulable once Ready
+		logger.Info("strategy stopped while waiting for the server to boot, uncordoning node")
+		t.uncordon(nodeName)
+		t.setState(nodeName, ServerOn)
+		return
+	}
+	if err != nil {
+		logger.Error("node did not become ready in time, turning server off", zap.Error(err),
+			zap.Duration("bootTimeout", bootTimeout))
+		if err = srvSwitch.ForceOff(); err != nil {
+			logger.Error("error forcing off server", zap.Error(err))
+		}
+		t.setState(nodeName, ServerOff)
+		t.mu.Lock()
+		t.waitList[nodeName] = time.Now().Add(BootFailureBackoff)
+		t.mu.Unlock()
+		return
+	}
+	t.uncordon(nodeName)
+	logger.Info("turned on server successfully")
+	t.mu.Lock()
+	t.poweredOnAt[nodeName] = time.Now()
+	t.mu.Unlock()
+	t.setState(nodeName, ServerOn)
+}
+
+func (t *ServerOnOffStrategy) waitForNodeReady(ctx context.Context, nodeName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ready, err := t.kubeClient.IsNodeReady(nodeName)
+		if err == nil && ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return errors.New("timeout waiting for node to be ready")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(DefaultPowerStateInterval):
+		}
+	}
+}
+
+func (t *ServerOnOffStrategy) uncordon(nodeName string) {
+	if err := t.kubeClient.UncordonNode(nodeName); err != nil {
+		t.logger.Error("error uncordoning node", zap.Error(err), zap.String("nodeName", nodeName))
+		return
+	}
+	if schedulable, ok := t.schedulable[nodeName]; ok {
+		schedulable.Uncordon()
+	}
+}
+
+func (t *ServerOnOffStrategy) getState(nodeName string) ServerPowerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.states[nodeName]
+}
+
+// inState returns whether any server is in the state.
+func (t *ServerOnOffStrategy) inState(state ServerPowerState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *ServerOnOffStrategy) setState(nodeName string, state ServerPowerState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.states[nodeName] = state
+}
+
+// cooldown keeps the server from being switched again for ServerCooldown, unless a longer wait is already set.
+func (t *ServerOnOffStrategy) cooldown(nodeName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(ServerCooldown); until.After(t.waitList[nodeName]) {
+		t.waitList[nodeName] = until
+	}
+}
+
+func (t *ServerOnOffStrategy) isCoolingDown(nodeName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Before(t.waitList[nodeName])
 }
@@ -1,6 +1,7 @@
 package scheduling
 
 import (
+	"context"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 	. "git.helio.dev/eco-qube/target-exporter/pkg/promclient"
 	"go.uber.org/zap"
@@ -40,11 +41,12 @@ func NewAutomaticJobSpawn(orchestrator *Orchestrator, kubeClient *Kubeclient, pr
 		resetTime:  time.Now(),
 		spawnCount: 0,
 	}
-	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("automaticJobSpawn", strategy.Reconcile, logger.With(zap.String("strategy", "automaticJobSpawn")))
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("automaticJobSpawn", strategy.Reconcile,
+		logger.With(zap.String("strategy", "automaticJobSpawn")), Interval(ReconciliationDelay))
 	return strategy
 }
 
-func (t *AutomaticJobSpawn) Reconcile() error {
+func (t *AutomaticJobSpawn) Reconcile(ctx context.Context) error {
 	// is there room for a new job?
 	//	yes: spawn a new job
 	//	no: requeue()
@@ -79,32 +81,19 @@ func (t *AutomaticJobSpawn) Reconcile() error {
 				WorkingScenario(map[string]float64{}),
 			}
 
-			err = t.o.AddWorkload(opts...)
+			_, err = t.o.AddWorkload(opts...)
 			if err != nil {
 				t.logger.Error("error adding workload", zap.Error(err))
 				return err
 			}
 			t.spawnCount++
+			t.RecordAction()
 			break
 		}
 	}
-	time.Sleep(ReconciliationDelay)
-
 	return nil
 }
 
-func (t *AutomaticJobSpawn) IsAutomaticJobSpawnEnabled() bool {
-	return t.isRunning
-}
-
-func (t *AutomaticJobSpawn) Start() {
-	t.BaseConcurrentStrategy.Start()
-}
-
-func (t *AutomaticJobSpawn) Stop() {
-	t.BaseConcurrentStrategy.Stop()
-}
-
 func shouldReset(resetTime time.Time, spawnCount int) bool {
 	return resetTime.Before(time.Now()) && spawnCount >= MaxBurstPerNode
 }
@@ -0,0 +1,56 @@
+package scheduling
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// StateStore keeps the state document of the strategies, e.g. kubeclient.ConfigMapStateStore or FileStateStore.
+type StateStore interface {
+	// Load returns the state document, nil if it was never saved
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// StrategyState is the persisted state of a strategy: whether it is enabled, its interval and its parameters.
+type StrategyState struct {
+	Enabled    bool            `json:"enabled"`
+	Interval   string          `json:"interval,omitempty"`
+	Jitter     string          `json:"jitter,omitempty"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// FileStateStore keeps the state document in a local file, written atomically.
+type FileStateStore struct {
+	path string
+}
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+func (s *FileStateStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *FileStateStore) Save(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
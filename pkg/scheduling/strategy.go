@@ -1,7 +1,11 @@
 package scheduling
 
 import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -11,88 +15,278 @@ const (
 	Stop  = "stop"
 )
 
+// DefaultReconcileInterval is the time between two reconciliations of a strategy, unless configured otherwise.
+const DefaultReconcileInterval = 1 * time.Second
+
+var (
+	reconcileTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "target_exporter_reconcile_total",
+		Help: "Reconciliations of each strategy, by result (success or error).",
+	}, []string{"strategy", "result"})
+	reconcileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "target_exporter_reconcile_duration_seconds",
+		Help: "Duration of the reconciliations of each strategy.",
+	}, []string{"strategy"})
+	strategyActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "target_exporter_strategy_actions_total",
+		Help: "Actions taken by each strategy, e.g. a CPU limit patched, a target changed or a workload spawned.",
+	}, []string{"strategy"})
+	strategyRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "target_exporter_strategy_running",
+		Help: "1 if the strategy is running, 0 otherwise.",
+	}, []string{"strategy"})
+)
+
+// StrategyStats is the state of a strategy and the statistics of its reconciliations since target-exporter started.
+type StrategyStats struct {
+	Name          string    `json:"name"`
+	Running       bool      `json:"running"`
+	Interval      string    `json:"interval"`
+	Jitter        string    `json:"jitter"`
+	LastReconcile time.Time `json:"lastReconcile"`
+	// LastDuration is the duration of the last reconciliation, in seconds
+	LastDuration float64 `json:"lastDuration"`
+	LastError    string  `json:"lastError,omitempty"`
+	Reconciles   uint64  `json:"reconciles"`
+	Errors       uint64  `json:"errors"`
+	Actions      uint64  `json:"actions"`
+	// Resources are the resources the strategy mutates
+	Resources []Resource `json:"resources"`
+	// Internal strategies are loops of the orchestrator, always running, that cannot be started or stopped by name
+	Internal bool `json:"internal,omitempty"`
+}
+
 type ConcurrentStrategy interface {
 	Start()
 	Stop()
-	IsRunning()
+	IsRunning() bool
+}
+
+type StrategyOption func(*BaseConcurrentStrategy)
+
+// Interval sets the time between the end of a reconciliation and the start of the next one.
+func Interval(interval time.Duration) StrategyOption {
+	return func(c *BaseConcurrentStrategy) {
+		c.interval = interval
+	}
 }
 
+// Internal marks the strategy as an internal loop of the orchestrator, it is not started, stopped or persisted through
+// the StrategyRegistry.
+func Internal() StrategyOption {
+	return func(c *BaseConcurrentStrategy) {
+		c.internal = true
+	}
+}
+
+// BaseConcurrentStrategy runs a reconcile function in its own goroutine, every interval, while started. Stopping it
+// cancels the context of the reconciliation in progress, if any, and waits for it to finish.
 type BaseConcurrentStrategy struct {
 	strategyName string
 	logger       *zap.Logger
-	reconcile    func() error
+	reconcile    func(ctx context.Context) error
 
-	mu          *sync.Mutex
-	initialized bool
-	isRunning   bool
-	startStop   chan string
+	mu        sync.Mutex
+	parent    context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	isRunning bool
+	interval  time.Duration
+	jitter    time.Duration
+	stats     StrategyStats
+	resources []Resource
+	internal  bool
+	arbiter   *Arbiter
 }
 
-func NewBaseConcurrentStrategy(strategyName string, reconcile func() error, logger *zap.Logger) *BaseConcurrentStrategy {
-	return &BaseConcurrentStrategy{
+func NewBaseConcurrentStrategy(strategyName string, reconcile func(ctx context.Context) error, logger *zap.Logger, options ...StrategyOption) *BaseConcurrentStrategy {
+	c := &BaseConcurrentStrategy{
 		strategyName: strategyName,
 		logger:       logger.With(zap.String("strategyName", strategyName)),
 		reconcile:    reconcile,
-
-		mu:          &sync.Mutex{},
-		initialized: false,
-		isRunning:   false,
-		startStop:   make(chan string),
+		parent:       context.Background(),
+		interval:     DefaultReconcileInterval,
+	}
+	for _, option := range options {
+		option(c)
 	}
+	strategyRunning.WithLabelValues(strategyName).Set(0)
+	return c
 }
 
-func (c *BaseConcurrentStrategy) Start() {
+// SetContext sets the parent context of the reconcile loop, cancelling it stops the strategy. It applies from the
+// next Start.
+func (c *BaseConcurrentStrategy) SetContext(ctx context.Context) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.parent = ctx
+}
 
-	c.logger.Info("starting strategy")
-	if !c.initialized {
-		c.initialized = true
-		c.run()
-	}
-	c.startStop <- Start
+// SetInterval changes the reconcile interval and jitter, it applies from the next reconciliation.
+func (c *BaseConcurrentStrategy) SetInterval(interval, jitter time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interval = interval
+	c.jitter = jitter
 }
 
-func (c *BaseConcurrentStrategy) Stop() {
+func (c *BaseConcurrentStrategy) Name() string {
+	return c.strategyName
+}
+
+func (c *BaseConcurrentStrategy) Start() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.isRunning {
+		return
+	}
+	c.logger.Info("starting strategy")
+	ctx, cancel := context.WithCancel(c.parent)
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.isRunning = true
+	strategyRunning.WithLabelValues(c.strategyName).Set(1)
+	go c.run(ctx, c.done)
+}
 
+// Stop stops the strategy and waits for the reconciliation in progress to finish.
+func (c *BaseConcurrentStrategy) Stop() {
+	c.Halt()
+}
+
+// Halt stops the reconcile loop like Stop, without the cleanup strategies overriding Stop do, e.g. resetting gauges.
+func (c *BaseConcurrentStrategy) Halt() {
+	c.mu.Lock()
+	if !c.isRunning {
+		c.mu.Unlock()
+		return
+	}
 	c.logger.Debug("stopping strategy")
-	c.startStop <- Stop
+	c.cancel()
+	c.isRunning = false
+	strategyRunning.WithLabelValues(c.strategyName).Set(0)
+	done := c.done
+	c.mu.Unlock()
+	<-done
 }
 
 func (c *BaseConcurrentStrategy) IsRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.isRunning
 }
 
-func (c *BaseConcurrentStrategy) run() {
-	go func() {
-		run := false
-		for {
-			select {
-			case command, ok := <-c.startStop:
-				if ok {
-					if command == Start {
-						run = true
-						c.isRunning = true
-					} else {
-						run = false
-						c.isRunning = false
-					}
-				} else {
-					c.logger.Info("startStop channel closed")
-					break
-				}
-			default:
-				//c.logger.Debug("startStop channel empty, continuing", zap.Bool("run", run))
-			}
-			if run {
-				err := c.reconcile()
-				if err != nil {
-					c.logger.Error("error while reconciling", zap.Error(err))
-				}
+// Resources returns the resources the strategy mutates.
+func (c *BaseConcurrentStrategy) Resources() []Resource {
+	return c.resources
+}
+
+// SetArbiter sets the arbiter serializing the mutations of the nodes with the other strategies.
+func (c *BaseConcurrentStrategy) SetArbiter(arbiter *Arbiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.arbiter = arbiter
+}
+
+// Acquire locks the node for the strategy to mutate the resource, see Arbiter.Acquire. Without an arbiter the
+// mutation is always allowed.
+func (c *BaseConcurrentStrategy) Acquire(nodeName string, resource Resource) (release func(), ok bool) {
+	c.mu.Lock()
+	arbiter := c.arbiter
+	c.mu.Unlock()
+	if arbiter == nil {
+		return func() {}, true
+	}
+	return arbiter.Acquire(c.strategyName, nodeName, resource)
+}
+
+// Begin starts a long mutation of a resource of a node through the arbiter, see Arbiter.Begin.
+func (c *BaseConcurrentStrategy) Begin(nodeName string, resource Resource) (end func(), ok bool) {
+	c.mu.Lock()
+	arbiter := c.arbiter
+	c.mu.Unlock()
+	if arbiter == nil {
+		return func() {}, true
+	}
+	return arbiter.Begin(c.strategyName, nodeName, resource)
+}
+
+// Stats returns the state of the strategy and the statistics of its reconciliations.
+func (c *BaseConcurrentStrategy) Stats() StrategyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Name = c.strategyName
+	stats.Running = c.isRunning
+	stats.Interval = c.interval.String()
+	stats.Jitter = c.jitter.String()
+	stats.Resources = c.resources
+	stats.Internal = c.internal
+	return stats
+}
+
+// RecordAction counts an action taken by the strategy on the cluster or on the exported gauges.
+func (c *BaseConcurrentStrategy) RecordAction() {
+	c.mu.Lock()
+	c.stats.Actions++
+	c.mu.Unlock()
+	strategyActions.WithLabelValues(c.strategyName).Inc()
+}
+
+func (c *BaseConcurrentStrategy) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		c.reconcileOnce(ctx)
+		timer := time.NewTimer(c.nextDelay())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.mu.Lock()
+			// The parent context may have been cancelled, unless the strategy was restarted meanwhile
+			if c.done == done {
+				c.isRunning = false
+				strategyRunning.WithLabelValues(c.strategyName).Set(0)
 			}
-			time.Sleep(1 * time.Second)
+			c.mu.Unlock()
+			c.logger.Debug("strategy stopped")
+			return
+		case <-timer.C:
 		}
-	}()
+	}
+}
+
+// reconcileOnce runs the reconcile function and records its duration and result.
+func (c *BaseConcurrentStrategy) reconcileOnce(ctx context.Context) {
+	start := time.Now()
+	err := c.reconcile(ctx)
+	duration := time.Since(start)
+
+	result := "success"
+	if err != nil {
+		result = "error"
+		c.logger.Error("error while reconciling", zap.Error(err))
+	}
+	reconcileTotal.WithLabelValues(c.strategyName, result).Inc()
+	reconcileDuration.WithLabelValues(c.strategyName).Observe(duration.Seconds())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.LastReconcile = start
+	c.stats.LastDuration = duration.Seconds()
+	c.stats.Reconciles++
+	if err != nil {
+		c.stats.LastError = err.Error()
+		c.stats.Errors++
+	} else {
+		c.stats.LastError = ""
+	}
+}
+
+func (c *BaseConcurrentStrategy) nextDelay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.jitter <= 0 {
+		return c.interval
+	}
+	return c.interval + time.Duration(rand.Int63n(int64(c.jitter)))
 }
@@ -0,0 +1,184 @@
+package scheduling
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// eventually fails the test if cond is not true within a second.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func countingStrategy(count *atomic.Int64, options ...StrategyOption) *BaseConcurrentStrategy {
+	return NewBaseConcurrentStrategy("test", func(ctx context.Context) error {
+		count.Add(1)
+		return nil
+	}, zap.NewNop(), options...)
+}
+
+func TestStrategyStartStopRestart(t *testing.T) {
+	var count atomic.Int64
+	strategy := countingStrategy(&count, Interval(time.Millisecond))
+
+	strategy.Start()
+	strategy.Start()
+	if !strategy.IsRunning() {
+		t.Fatal("strategy not running after Start")
+	}
+	eventually(t, func() bool { return count.Load() >= 3 }, "strategy did not reconcile")
+
+	strategy.Stop()
+	strategy.Stop()
+	if strategy.IsRunning() {
+		t.Fatal("strategy running after Stop")
+	}
+	stopped := count.Load()
+	time.Sleep(10 * time.Millisecond)
+	if count.Load() != stopped {
+		t.Fatalf("strategy reconciled after Stop: %d, then %d", stopped, count.Load())
+	}
+
+	strategy.Start()
+	eventually(t, func() bool { return count.Load() > stopped }, "restarted strategy did not reconcile")
+	strategy.Stop()
+}
+
+func TestStrategyInterval(t *testing.T) {
+	var count atomic.Int64
+	strategy := countingStrategy(&count, Interval(time.Hour))
+	strategy.Start()
+	defer strategy.Stop()
+
+	eventually(t, func() bool { return count.Load() == 1 }, "strategy did not reconcile on Start")
+	time.Sleep(20 * time.Millisecond)
+	if count.Load() != 1 {
+		t.Fatalf("strategy reconciled %d times within its interval", count.Load())
+	}
+	if stats := strategy.Stats(); stats.Interval != time.Hour.String() || stats.Reconciles != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestStrategyNextDelay(t *testing.T) {
+	strategy := NewBaseConcurrentStrategy("test", func(ctx context.Context) error { return nil }, zap.NewNop())
+	if delay := strategy.nextDelay(); delay != DefaultReconcileInterval {
+		t.Fatalf("default delay is %s, want %s", delay, DefaultReconcileInterval)
+	}
+	strategy.SetInterval(10*time.Millisecond, 5*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if delay := strategy.nextDelay(); delay < 10*time.Millisecond || delay >= 15*time.Millisecond {
+			t.Fatalf("delay %s out of [10ms, 15ms)", delay)
+		}
+	}
+}
+
+func TestStrategyStopCancelsReconcile(t *testing.T) {
+	started := make(chan struct{})
+	var cancelled atomic.Bool
+	strategy := NewBaseConcurrentStrategy("test", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		cancelled.Store(true)
+		return ctx.Err()
+	}, zap.NewNop(), Interval(time.Hour))
+
+	strategy.Start()
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		strategy.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not cancel the reconciliation in progress")
+	}
+	if !cancelled.Load() {
+		t.Fatal("Stop returned before the reconciliation finished")
+	}
+	if stats := strategy.Stats(); stats.Errors != 1 || stats.LastError != context.Canceled.Error() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestStrategyParentContext(t *testing.T) {
+	var count atomic.Int64
+	strategy := countingStrategy(&count, Interval(time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	strategy.SetContext(ctx)
+
+	strategy.Start()
+	eventually(t, func() bool { return count.Load() >= 1 }, "strategy did not reconcile")
+	cancel()
+	eventually(t, func() bool { return !strategy.IsRunning() }, "strategy still running after its context was cancelled")
+
+	// A new context lets the strategy be started again
+	strategy.SetContext(context.Background())
+	stopped := count.Load()
+	strategy.Start()
+	eventually(t, func() bool { return count.Load() > stopped }, "restarted strategy did not reconcile")
+	strategy.Stop()
+}
+
+func TestStrategyStats(t *testing.T) {
+	fail := errors.New("failed")
+	var calls atomic.Int64
+	strategy := NewBaseConcurrentStrategy("test", func(ctx context.Context) error {
+		if calls.Add(1) == 1 {
+			return fail
+		}
+		return nil
+	}, zap.NewNop(), Interval(time.Millisecond))
+	strategy.Start()
+	eventually(t, func() bool { return strategy.Stats().Reconciles >= 2 }, "strategy did not reconcile")
+	strategy.Stop()
+	strategy.RecordAction()
+
+	stats := strategy.Stats()
+	if stats.Errors != 1 || stats.LastError != "" || stats.Actions != 1 || stats.Running {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRegistryApplyInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval string
+		jitter   string
+		want     time.Duration
+	}{
+		{"valid", "5m", "10s", 5 * time.Minute},
+		{"no jitter", "5m", "", 5 * time.Minute},
+		{"zero interval", "0s", "", time.Hour},
+		{"negative interval", "-5m", "", time.Hour},
+		{"negative jitter", "5m", "-10s", time.Hour},
+		{"invalid jitter", "5m", "soon", time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count atomic.Int64
+			registry := NewStrategyRegistry(NewArbiter(time.Minute, zap.NewNop()), ConflictWarn, zap.NewNop())
+			if err := registry.Register(countingStrategy(&count, Interval(time.Hour))); err != nil {
+				t.Fatal(err)
+			}
+			registry.Apply(map[string]StrategyState{"test": {Interval: tt.interval, Jitter: tt.jitter}})
+			strategy, _ := registry.Get("test")
+			if stats := strategy.Stats(); stats.Interval != tt.want.String() {
+				t.Fatalf("interval = %s, want %s", stats.Interval, tt.want)
+			}
+		})
+	}
+}
@@ -1,28 +1,305 @@
 package scheduling
 
 import (
+	"context"
+	"errors"
 	"git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
 	"git.helio.dev/eco-qube/target-exporter/pkg/promclient"
+	"git.helio.dev/eco-qube/target-exporter/pkg/pyzhm"
 	"go.uber.org/zap"
 )
 
+// MaxTawaBatchSize is the maximum number of queued workloads sent to pyzhm in a single prediction.
+const MaxTawaBatchSize = 8
+
+// TawaStrategy admits queued workloads binding each of them to the node predicted by the placer (pyzhm by default). Workloads are placed in
+// batches so that the optimizer can take sibling jobs into account.
 type TawaStrategy struct {
 	*BaseConcurrentStrategy
-	kubeClient *kubeclient.Kubeclient
-	promClient *promclient.Promclient
+	o                 *Orchestrator
+	promClient        *promclient.Promclient
+	placer            pyzhm.Placer
+	pyzhmNodeMappings *pyzhm.NodeMappings
+	// deferred is the last deferred or failed outcome and reason recorded for each queued workload
+	deferred map[string]string
 }
 
-func NewTawaStrategy(kubeClient *kubeclient.Kubeclient, promClient *promclient.Promclient, logger *zap.Logger) *TawaStrategy {
+func NewTawaStrategy(orchestrator *Orchestrator, promClient *promclient.Promclient, placer pyzhm.Placer,
+	pyzhmNodeMappings *pyzhm.NodeMappings, logger *zap.Logger) *TawaStrategy {
 	strategy := &TawaStrategy{
-		kubeClient: kubeClient,
-		promClient: promClient,
+		o:                 orchestrator,
+		promClient:        promClient,
+		placer:            placer,
+		pyzhmNodeMappings: pyzhmNodeMappings,
+		deferred:          make(map[string]string),
 	}
-	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("tawa", strategy.Reconcile, logger.With(zap.String("strategy", "tawa")))
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("tawa", strategy.Reconcile, logger.With(zap.String("strategy", "tawa")),
+		Interval(AdmissionDelay))
 	return strategy
 }
 
-func (s *TawaStrategy) Reconcile() error {
-	// TODO: This is to be done for the "real" strategy, when we have a job queue. For now, we skip this.
-	s.logger.Debug("not yet implemented")
+func (s *TawaStrategy) Reconcile(ctx context.Context) error {
+	// While the placer is down (e.g. the pyzhm circuit breaker is open), workloads are admitted without placement
+	if !pyzhm.IsAvailable(s.placer) {
+		s.logger.Debug("placer unavailable, skipping placement")
+		return nil
+	}
+	eligible := s.o.queue.Eligible()
+	s.pruneDeferred(eligible)
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	// Workloads carrying their own working scenario are predicted on their own, workloads submitted as a batch are
+	// predicted and applied together, the others share a best-effort batch
+	// A batch failing to be placed stays queued without keeping the others from being placed
+	var errs []error
+	batches := make(map[string][]*QueuedWorkload)
+	unbatched := make([]*QueuedWorkload, 0, MaxTawaBatchSize)
+	for _, item := range eligible {
+		switch {
+		case len(item.Options.WorkingScenario) > 0:
+			if err := s.place(ctx, []*QueuedWorkload{item}, item.Options.WorkingScenario, false); err != nil {
+				errs = append(errs, err)
+			}
+		case item.BatchId != "":
+			batches[item.BatchId] = append(batches[item.BatchId], item)
+		case len(unbatched) < MaxTawaBatchSize:
+			unbatched = append(unbatched, item)
+		}
+	}
+	if len(batches) > 0 || len(unbatched) > 0 {
+		currentEnergyConsumption, err := s.promClient.GetCurrentEnergyConsumption()
+		if err != nil {
+			s.logger.Error("failed to get current energy consumption", zap.Error(err))
+			return err
+		}
+		for _, batch := range batches {
+			if err = s.place(ctx, batch, currentEnergyConsumption, true); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(unbatched) > 0 {
+			if err = s.place(ctx, unbatched, currentEnergyConsumption, false); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// place asks the placer where to run the batch given the power scenario and spawns each workload on its predicted node.
+// Workloads predicted on a node without room (diff <= 0) stay queued. If atomic is set, the whole batch stays queued
+// unless every workload can be placed, and it is rejected as a whole if spawning fails for good or two of its
+// workloads share a job name.
+func (s *TawaStrategy) place(ctx context.Context, batch []*QueuedWorkload, powerScenario map[string]float64, atomic bool) error {
+	cpuCounts, err := s.promClient.GetCpuCounts()
+	if err != nil {
+		s.logger.Error("failed to get cpu counts", zap.Error(err))
+		return err
+	}
+	scenario := pyzhm.NewScenario(powerScenario)
+	accepted := make([]*QueuedWorkload, 0, len(batch))
+	for _, item := range batch {
+		coreCount, err := kubeclient.PercentageToResourceQuantity(cpuCounts, float64(item.Options.CpuTarget), s.o.referenceNodeName())
+		if err != nil {
+			s.logger.Error("failed to convert cpu target to resource quantity", zap.Error(err))
+			return err
+		}
+		// A workload whose job name is already in the scenario can never be placed, it is rejected without failing
+		// the other workloads, unless the batch is atomic
+		if err = scenario.AddJob(item.Options.JobName, float64(coreCount.Value())); err != nil {
+			if atomic {
+				s.rejectBatch(batch, err)
+				return nil
+			}
+			s.reject(item, err)
+			continue
+		}
+		accepted = append(accepted, item)
+	}
+	batch = accepted
+	if len(batch) == 0 {
+		return nil
+	}
+
+	decisions := make(map[string]*PlacementDecision)
+	for _, item := range batch {
+		decisions[item.Id] = &PlacementDecision{
+			WorkloadId:   item.Id,
+			BatchId:      item.BatchId,
+			JobName:      item.Options.JobName,
+			Scenario:     scenario.Scenario,
+			Requirements: scenario.Requirements,
+		}
+	}
+	defer func() {
+		for _, decision := range decisions {
+			s.record(*decision)
+		}
+	}()
+
+	predictions, err := pyzhm.Predict(ctx, s.placer, scenario)
+	if err != nil {
+		s.logger.Error("failed to get predictions", zap.Error(err))
+		for _, decision := range decisions {
+			decision.Outcome = PlacementFailed
+			decision.Reason = err.Error()
+		}
+		return err
+	}
+
+	placed := make([]*QueuedWorkload, 0, len(batch))
+	nodeNames := make([]string, 0, len(batch))
+	for _, item := range batch {
+		decision := decisions[item.Id]
+		decision.Placer = predictions.Placer
+		decision.FallbackReason = predictions.FallbackReason
+		decision.Outcome = PlacementDeferred
+		label, err := predictions.NodeLabel(item.Options.JobName)
+		if err != nil {
+			decision.Reason = err.Error()
+			s.logger.Error("no predicted node, keeping workload queued", zap.String("id", item.Id), zap.Error(err))
+			continue
+		}
+		decision.PredictedLabel = label
+		// Map node names according to yaml config since pyzhm uses different node names than Kubernetes node names
+		nodeName, err := s.pyzhmNodeMappings.NodeName(label)
+		if err != nil {
+			decision.Reason = err.Error()
+			s.logger.Error("unmapped predicted label, keeping workload queued", zap.String("id", item.Id), zap.Error(err))
+			continue
+		}
+		decision.PredictedNode = nodeName
+		diffNode, err := s.promClient.GetNodeCpuDiff(nodeName)
+		if err != nil {
+			decision.Reason = err.Error()
+			s.logger.Error("failed to get node cpu diff", zap.Error(err))
+			return err
+		}
+		decision.NodeCpuDiff = &diffNode
+		if diffNode <= 0 {
+			decision.Reason = "predicted node has no room (cpu diff <= 0)"
+			s.logger.Debug("predicted node has no room, keeping workload queued", zap.String("id", item.Id),
+				zap.String("nodeName", nodeName), zap.Float64("diff", diffNode))
+			continue
+		}
+		placed = append(placed, item)
+		nodeNames = append(nodeNames, nodeName)
+	}
+
+	if !atomic {
+		for i, item := range placed {
+			s.admit(item, nodeNames[i], s.o.spawnWorkload(item.Options, nodeNames[i]), decisions[item.Id])
+		}
+		return nil
+	}
+	if len(placed) < len(batch) {
+		s.logger.Debug("not every workload of the batch can be placed, keeping batch queued",
+			zap.String("batchId", batch[0].BatchId), zap.Int("placed", len(placed)), zap.Int("batchSize", len(batch)))
+		for _, item := range placed {
+			decisions[item.Id].Reason = "not every workload of the batch can be placed"
+		}
+		return nil
+	}
+	spawnOptions := make([]WorkloadSpawnOptions, len(placed))
+	for i, item := range placed {
+		spawnOptions[i] = item.Options
+	}
+	err = s.o.spawnWorkloads(spawnOptions, nodeNames)
+	for i, item := range placed {
+		s.admit(item, nodeNames[i], err, decisions[item.Id])
+	}
 	return nil
 }
+
+// record adds the decision to the decision log, unless the workload stays queued for the same reason as last round.
+func (s *TawaStrategy) record(decision PlacementDecision) {
+	if decision.Outcome == PlacementDeferred || decision.Outcome == PlacementFailed {
+		key := string(decision.Outcome) + ": " + decision.Reason
+		if s.deferred[decision.WorkloadId] == key {
+			return
+		}
+		s.deferred[decision.WorkloadId] = key
+	} else {
+		delete(s.deferred, decision.WorkloadId)
+	}
+	s.o.decisions.Record(decision)
+}
+
+// pruneDeferred forgets the last outcomes of the workloads no longer queued.
+func (s *TawaStrategy) pruneDeferred(eligible []*QueuedWorkload) {
+	queued := make(map[string]bool, len(eligible))
+	for _, item := range eligible {
+		queued[item.Id] = true
+	}
+	for id := range s.deferred {
+		if !queued[id] {
+			delete(s.deferred, id)
+		}
+	}
+}
+
+// rejectBatch removes every workload of the batch from the queue.
+func (s *TawaStrategy) rejectBatch(batch []*QueuedWorkload, err error) {
+	s.logger.Error("rejecting batch", zap.String("batchId", batch[0].BatchId), zap.Error(err))
+	for _, item := range batch {
+		s.reject(item, err)
+	}
+}
+
+// reject removes the workload from the queue before it was sent to the placer.
+func (s *TawaStrategy) reject(item *QueuedWorkload, err error) {
+	s.logger.Error("rejecting workload", zap.String("id", item.Id), zap.String("jobName", item.Options.JobName),
+		zap.Error(err))
+	s.record(PlacementDecision{
+		WorkloadId: item.Id,
+		BatchId:    item.BatchId,
+		JobName:    item.Options.JobName,
+		Outcome:    PlacementRejected,
+		Reason:     err.Error(),
+	})
+	s.o.queue.Reject(item.Id, err.Error())
+}
+
+func (s *TawaStrategy) admit(item *QueuedWorkload, nodeName string, spawnErr error, decision *PlacementDecision) {
+	if spawnErr != nil {
+		decision.Reason = spawnErr.Error()
+		// Transient errors leave the workload queued to be placed again
+		if !isPermanentSpawnError(spawnErr) {
+			decision.Outcome = PlacementDeferred
+			return
+		}
+		decision.Outcome = PlacementRejected
+		s.o.queue.Reject(item.Id, spawnErr.Error())
+		return
+	}
+	decision.Outcome = PlacementPlaced
+	decision.NodeName = nodeName
+	s.logger.Info("workload placed", zap.String("id", item.Id), zap.String("jobName", item.Options.JobName),
+		zap.String("nodeName", nodeName))
+	s.o.queue.Admit(item.Id, nodeName)
+	s.RecordAction()
+}
+
+// NewFreeCoresFunc returns a pyzhm.CapacityFunc computing the free cores of each node label from its current CPU diff.
+func NewFreeCoresFunc(promClient *promclient.Promclient, pyzhmNodeMappings *pyzhm.NodeMappings) pyzhm.CapacityFunc {
+	return func() (map[string]float64, error) {
+		diffs, err := promClient.GetCurrentCpuDiff()
+		if err != nil {
+			return nil, err
+		}
+		cpuCounts, err := promClient.GetCpuCounts()
+		if err != nil {
+			return nil, err
+		}
+		freeCoresByNode := make(map[string]float64)
+		for _, diff := range diffs {
+			if len(diff.Data) == 0 {
+				continue
+			}
+			freeCoresByNode[diff.NodeName] = diff.Data[0].Usage / 100 * float64(cpuCounts[diff.NodeName])
+		}
+		return pyzhmNodeMappings.ByLabel(freeCoresByNode), nil
+	}
+}
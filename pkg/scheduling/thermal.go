@@ -0,0 +1,345 @@
+package scheduling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "git.helio.dev/eco-qube/target-exporter/pkg/promclient"
+	. "git.helio.dev/eco-qube/target-exporter/pkg/pyzhm"
+	. "git.helio.dev/eco-qube/target-exporter/pkg/serverswitch"
+	"go.uber.org/zap"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ThermalInterval = 30 * time.Second
+	// ThermalStepInterval is the minimum time between two target changes of the same node, to let it cool down or
+	// heat up
+	ThermalStepInterval = 2 * time.Minute
+	// ThermalTargetStep is how much a target is changed at each step when no setpoints are configured
+	ThermalTargetStep = 10.0
+	// MaxTemperatureAge is how old a BMC temperature reading can be to be trusted
+	MaxTemperatureAge = 5 * time.Minute
+)
+
+// TemperatureSource returns the latest inlet and CPU temperatures of a node, e.g. a serverswitch.Monitor.
+type TemperatureSource interface {
+	Temperatures(nodeName string) (Temperatures, bool)
+}
+
+// ThermalThresholds are the temperatures, in Celsius, above which targets are lowered. Above the high threshold the
+// target is lowered by one step, above the critical one it is set to the lowest setpoint. Targets are raised back one
+// step at a time once the temperature is below the high threshold minus the hysteresis. SideOffsets are added to the
+// thresholds of the nodes on a rack side ("L" or "R", from the pyzhm label), e.g. -2 for the side cooled last.
+type ThermalThresholds struct {
+	InletHigh     float64            `json:"inletHigh"`
+	InletCritical float64            `json:"inletCritical"`
+	CpuHigh       float64            `json:"cpuHigh"`
+	CpuCritical   float64            `json:"cpuCritical"`
+	Hysteresis    float64            `json:"hysteresis"`
+	SideOffsets   map[string]float64 `json:"sideOffsets"`
+	// InletQuery and CpuQuery, if set, are Prometheus queries returning the temperatures by NodeLabel instead of
+	// reading them from the BMCs
+	InletQuery string `json:"inletQuery"`
+	CpuQuery   string `json:"cpuQuery"`
+	NodeLabel  string `json:"nodeLabel"`
+}
+
+// ThermalStrategy lowers the Target of nodes that run too hot and raises it back, up to the target set before
+// throttling, as they cool. As hot air recirculates along a rack side, a node is considered as hot as the average
+// inlet temperature of its side if that is higher than its own.
+type ThermalStrategy struct {
+	*BaseConcurrentStrategy
+
+	promClient        *Promclient
+	temperatures      TemperatureSource
+	pyzhmNodeMappings *NodeMappings
+	targets           map[string]*Target
+	setpoints         []float64
+	logger            *zap.Logger
+
+	// mu protects the thresholds, which can be changed while reconciling
+	mu         sync.Mutex
+	thresholds ThermalThresholds
+
+	// throttled keeps the target of each throttled node before it was lowered
+	throttled  map[string]float64
+	lastChange map[string]time.Time
+}
+
+func NewThermalStrategy(promClient *Promclient, temperatures TemperatureSource, pyzhmNodeMappings *NodeMappings,
+	targets map[string]*Target, setpoints []float64, thresholds ThermalThresholds, logger *zap.Logger) *ThermalStrategy {
+	if thresholds.NodeLabel == "" {
+		thresholds.NodeLabel = "node"
+	}
+	strategy := &ThermalStrategy{
+		promClient:        promClient,
+		temperatures:      temperatures,
+		pyzhmNodeMappings: pyzhmNodeMappings,
+		targets:           targets,
+		setpoints:         setpoints,
+		thresholds:        thresholds,
+		logger:            logger,
+		throttled:         make(map[string]float64),
+		lastChange:        make(map[string]time.Time),
+	}
+	strategy.BaseConcurrentStrategy = NewBaseConcurrentStrategy("thermal", strategy.Reconcile,
+		logger.With(zap.String("strategy", "thermal")), Interval(ThermalInterval), Mutates(ResourceTargets))
+	return strategy
+}
+
+type nodeTemperatures struct {
+	inlet, cpu       float64
+	hasInlet, hasCpu bool
+}
+
+func (t *ThermalStrategy) Reconcile(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	temperatures, err := t.readTemperatures()
+	if err != nil {
+		t.logger.Error("error reading temperatures", zap.Error(err))
+		return err
+	}
+	sideInlets := t.sideInletAverages(temperatures)
+
+	for nodeName, target := range t.targets {
+		temps, ok := temperatures[nodeName]
+		if !ok {
+			continue
+		}
+		side := t.side(nodeName)
+		if sideInlet, ok := sideInlets[side]; ok && (!temps.hasInlet || sideInlet > temps.inlet) {
+			temps.inlet, temps.hasInlet = sideInlet, true
+		}
+		offset := t.thresholds.SideOffsets[side]
+		critical := (temps.hasInlet && t.thresholds.InletCritical > 0 && temps.inlet > t.thresholds.InletCritical+offset) ||
+			(temps.hasCpu && t.thresholds.CpuCritical > 0 && temps.cpu > t.thresholds.CpuCritical+offset)
+		hot := critical ||
+			(temps.hasInlet && t.thresholds.InletHigh > 0 && temps.inlet > t.thresholds.InletHigh+offset) ||
+			(temps.hasCpu && t.thresholds.CpuHigh > 0 && temps.cpu > t.thresholds.CpuHigh+offset)
+		cool := (!temps.hasInlet || t.thresholds.InletHigh <= 0 ||
+			temps.inlet < t.thresholds.InletHigh+offset-t.thresholds.Hysteresis) &&
+			(!temps.hasCpu || t.thresholds.CpuHigh <= 0 || temps.cpu < t.thresholds.CpuHigh+offset-t.thresholds.Hysteresis)
+		logger := t.logger.With(zap.String("nodeName", nodeName), zap.Float64("inlet", temps.inlet),
+			zap.Float64("cpu", temps.cpu), zap.String("side", side))
+
+		switch {
+		case critical:
+			t.lower(nodeName, target, t.lowestSetpoint(t.unthrottled(nodeName, target)), logger)
+		case hot && time.Since(t.lastChange[nodeName]) >= ThermalStepInterval:
+			t.lower(nodeName, target, t.lowerStep(target.GetTarget()), logger)
+		case cool && time.Since(t.lastChange[nodeName]) >= ThermalStepInterval:
+			t.raise(nodeName, target, logger)
+		}
+	}
+	return nil
+}
+
+// Parameters returns the thermal thresholds.
+func (t *ThermalStrategy) Parameters() interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	thresholds := t.thresholds
+	thresholds.SideOffsets = make(map[string]float64, len(t.thresholds.SideOffsets))
+	for side, offset := range t.thresholds.SideOffsets {
+		thresholds.SideOffsets[side] = offset
+	}
+	return thresholds
+}
+
+// SetParameters updates the thermal thresholds, they apply from the next reconciliation.
+func (t *ThermalStrategy) SetParameters(data []byte) error {
+	thresholds := t.Parameters().(ThermalThresholds)
+	if err := json.Unmarshal(data, &thresholds); err != nil {
+		return err
+	}
+	if thresholds.Hysteresis < 0 {
+		return fmt.Errorf("hysteresis must not be negative")
+	}
+	if thresholds.NodeLabel == "" {
+		thresholds.NodeLabel = "node"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.thresholds = thresholds
+	return nil
+}
+
+func (t *ThermalStrategy) Start() {
+	t.BaseConcurrentStrategy.Start()
+}
+
+// Stop stops the strategy and restores the targets of the throttled nodes.
+func (t *ThermalStrategy) Stop() {
+	t.BaseConcurrentStrategy.Stop()
+	for nodeName, original := range t.throttled {
+		if target, ok := t.targets[nodeName]; ok {
+			target.Set(original)
+		}
+		delete(t.throttled, nodeName)
+	}
+}
+
+func (t *ThermalStrategy) lower(nodeName string, target *Target, newTarget float64, logger *zap.Logger) {
+	current := target.GetTarget()
+	if newTarget >= current {
+		return
+	}
+	release, ok := t.Acquire(nodeName, ResourceTargets)
+	if !ok {
+		return
+	}
+	defer release()
+	if _, ok := t.throttled[nodeName]; !ok {
+		t.throttled[nodeName] = current
+	}
+	logger.Info("node too hot, lowering target", zap.Float64("target", current), zap.Float64("newTarget", newTarget))
+	target.Set(newTarget)
+	t.lastChange[nodeName] = time.Now()
+	t.RecordAction()
+}
+
+func (t *ThermalStrategy) raise(nodeName string, target *Target, logger *zap.Logger) {
+	original, ok := t.throttled[nodeName]
+	if !ok {
+		return
+	}
+	release, ok := t.Acquire(nodeName, ResourceTargets)
+	if !ok {
+		return
+	}
+	defer release()
+	current := target.GetTarget()
+	newTarget := t.higherStep(current)
+	if newTarget >= original || current >= original {
+		newTarget = original
+		delete(t.throttled, nodeName)
+	}
+	if newTarget <= current {
+		return
+	}
+	logger.Info("node cooled down, raising target", zap.Float64("target", current), zap.Float64("newTarget", newTarget))
+	target.Set(newTarget)
+	t.lastChange[nodeName] = time.Now()
+	t.RecordAction()
+}
+
+// readTemperatures reads the temperatures from the configured Prometheus queries or, if not set, from the BMCs.
+func (t *ThermalStrategy) readTemperatures() (map[string]nodeTemperatures, error) {
+	temperatures := make(map[string]nodeTemperatures)
+	if t.thresholds.InletQuery != "" {
+		inlets, err := t.promClient.GetValuesByLabel(t.thresholds.InletQuery, t.thresholds.NodeLabel)
+		if err != nil {
+			return nil, fmt.Errorf("error querying inlet temperatures: %w", err)
+		}
+		for nodeName, inlet := range inlets {
+			temps := temperatures[nodeName]
+			temps.inlet, temps.hasInlet = inlet, true
+			temperatures[nodeName] = temps
+		}
+	}
+	if t.thresholds.CpuQuery != "" {
+		cpus, err := t.promClient.GetValuesByLabel(t.thresholds.CpuQuery, t.thresholds.NodeLabel)
+		if err != nil {
+			return nil, fmt.Errorf("error querying cpu temperatures: %w", err)
+		}
+		for nodeName, cpu := range cpus {
+			temps := temperatures[nodeName]
+			temps.cpu, temps.hasCpu = cpu, true
+			temperatures[nodeName] = temps
+		}
+	}
+	if t.temperatures == nil {
+		return temperatures, nil
+	}
+	for nodeName := range t.targets {
+		bmcTemps, ok := t.temperatures.Temperatures(nodeName)
+		if !ok || time.Since(bmcTemps.Time) > MaxTemperatureAge {
+			continue
+		}
+		temps := temperatures[nodeName]
+		if !temps.hasInlet && t.thresholds.InletQuery == "" {
+			temps.inlet, temps.hasInlet = bmcTemps.Inlet, bmcTemps.HasInlet
+		}
+		if !temps.hasCpu && t.thresholds.CpuQuery == "" {
+			temps.cpu, temps.hasCpu = bmcTemps.Cpu, bmcTemps.HasCpu
+		}
+		temperatures[nodeName] = temps
+	}
+	return temperatures, nil
+}
+
+// sideInletAverages returns the average inlet temperature of each rack side.
+func (t *ThermalStrategy) sideInletAverages(temperatures map[string]nodeTemperatures) map[string]float64 {
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for nodeName, temps := range temperatures {
+		side := t.side(nodeName)
+		if side == "" || !temps.hasInlet {
+			continue
+		}
+		sums[side] += temps.inlet
+		counts[side]++
+	}
+	averages := make(map[string]float64)
+	for side, sum := range sums {
+		averages[side] = sum / float64(counts[side])
+	}
+	return averages
+}
+
+// side returns the rack side of a node, i.e. the first letter of its pyzhm label ("L1" -> "L"), if mapped.
+func (t *ThermalStrategy) side(nodeName string) string {
+	if t.pyzhmNodeMappings == nil {
+		return ""
+	}
+	label, err := t.pyzhmNodeMappings.Label(nodeName)
+	if err != nil || label == "" {
+		return ""
+	}
+	return strings.ToUpper(label[:1])
+}
+
+func (t *ThermalStrategy) lowerStep(current float64) float64 {
+	if len(t.setpoints) == 0 {
+		return math.Max(current-ThermalTargetStep, 0)
+	}
+	return getLowerSetpoint(t.setpoints, current)
+}
+
+func (t *ThermalStrategy) higherStep(current float64) float64 {
+	if len(t.setpoints) == 0 {
+		return current + ThermalTargetStep
+	}
+	higher := current
+	for _, setpoint := range t.setpoints {
+		if setpoint > current && (higher == current || setpoint < higher) {
+			higher = setpoint
+		}
+	}
+	return higher
+}
+
+// unthrottled returns the target of the node before it was throttled.
+func (t *ThermalStrategy) unthrottled(nodeName string, target *Target) float64 {
+	if original, ok := t.throttled[nodeName]; ok {
+		return original
+	}
+	return target.GetTarget()
+}
+
+// lowestSetpoint returns the target of a node too hot, from its unthrottled target so that it does not keep lowering.
+func (t *ThermalStrategy) lowestSetpoint(original float64) float64 {
+	if len(t.setpoints) == 0 {
+		return math.Max(original-2*ThermalTargetStep, 0)
+	}
+	lowest := t.setpoints[0]
+	for _, setpoint := range t.setpoints {
+		lowest = math.Min(lowest, setpoint)
+	}
+	return lowest
+}
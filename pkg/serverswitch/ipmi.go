@@ -1,16 +1,30 @@
 package serverswitch
 
 import (
+	"errors"
 	"fmt"
 	. "github.com/vmware/goipmi"
 	"go.uber.org/zap"
+	"sync"
+)
+
+const (
+	ProtocolIpmi    = "ipmi"
+	ProtocolRedfish = "redfish"
+	// ProtocolSimulated does not talk to any BMC, see SimulatedServerSwitch
+	ProtocolSimulated = "simulated"
 )
 
 type ServerSwitch interface {
 	PowerOn() error
+	// PowerOff shuts the server down gracefully
 	PowerOff() error
+	// ForceOff cuts the power of the server immediately
+	ForceOff() error
 	IsServerOn() (bool, error)
 	GetBmcEndpoint() string
+	// RetryConn re-establishes the connection to the BMC
+	RetryConn() error
 }
 
 type IpmiServerSwitch struct {
@@ -18,6 +32,10 @@ type IpmiServerSwitch struct {
 	c           *Client
 	connection  *Connection
 	logger      *zap.Logger
+
+	// goipmi sessions are not safe for concurrent use, e.g. by the on/off strategy and the sensor monitor
+	mu  sync.Mutex
+	sdr []sdrSensor
 }
 
 func NewIpmiServerSwitch(endpoint, username, password string, logger *zap.Logger) (*IpmiServerSwitch, error) {
@@ -30,36 +48,62 @@ func NewIpmiServerSwitch(endpoint, username, password string, logger *zap.Logger
 	}
 	client, err := open(*c)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: server %s: %v", ErrBmcUnreachable, endpoint, err)
 	}
 
 	return &IpmiServerSwitch{bmcEndpoint: endpoint, c: client, connection: c, logger: logger}, nil
 }
 
+// PowerOn powers the server up.
 func (i *IpmiServerSwitch) PowerOn() error {
-	//err := i.c.Open()
-	//if err != nil {
-	//	return err
-	//}
-	//defer i.c.Close()
-	return nil
+	return i.chassisControl(ControlPowerUp, "power on")
 }
 
+// PowerOff emulates a press of the power button (ACPI soft shutdown), letting the operating system shut down
+// gracefully.
 func (i *IpmiServerSwitch) PowerOff() error {
+	return i.chassisControl(ControlPowerAcpiSoft, "soft power off")
+}
+
+// ForceOff powers the server down immediately, without shutting down the operating system.
+func (i *IpmiServerSwitch) ForceOff() error {
+	return i.chassisControl(ControlPowerDown, "hard power off")
+}
+
+func (i *IpmiServerSwitch) chassisControl(control ChassisControl, action string) error {
 	request := &Request{
 		NetworkFunction: NetworkFunctionChassis,
 		Command:         CommandChassisControl,
-		Data:            &ChassisControlRequest{ChassisControl: ControlPowerCycle},
+		Data:            &ChassisControlRequest{ChassisControl: control},
 	}
 	response := &ChassisControlResponse{}
-	err := i.c.Send(request, response)
-	if err != nil {
-		i.logger.Error("error sending power off command", zap.Error(err))
+	if err := i.send(request, response); err != nil {
+		i.logger.Error("error sending chassis control command", zap.String("action", action), zap.Error(err))
 		return err
 	}
 	if response.CompletionCode != CommandCompleted {
-		i.logger.Error("error powering off server", zap.Uint8("completion_code", uint8(response.CompletionCode)))
-		return fmt.Errorf("error powering off server")
+		i.logger.Error("chassis control command rejected", zap.String("action", action),
+			zap.Uint8("completion_code", uint8(response.CompletionCode)))
+		return fmt.Errorf("%w: %s on server %s, completion code %#x", ErrCommandRejected, action, i.bmcEndpoint,
+			uint8(response.CompletionCode))
+	}
+	return nil
+}
+
+// send sends a request to the BMC, wrapping transport errors into ErrBmcUnreachable and completion codes other than
+// CommandCompleted into ErrCommandRejected.
+func (i *IpmiServerSwitch) send(request *Request, response Response) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.c == nil {
+		return fmt.Errorf("%w: client is nil for server %s", ErrBmcUnreachable, i.bmcEndpoint)
+	}
+	if err := i.c.Send(request, response); err != nil {
+		var code CompletionCode
+		if errors.As(err, &code) {
+			return fmt.Errorf("%w: server %s, completion code %#x", ErrCommandRejected, i.bmcEndpoint, uint8(code))
+		}
+		return fmt.Errorf("%w: server %s: %v", ErrBmcUnreachable, i.bmcEndpoint, err)
 	}
 	return nil
 }
@@ -71,16 +115,13 @@ func (i *IpmiServerSwitch) IsServerOn() (bool, error) {
 		Data:            &ChassisStatusRequest{},
 	}
 	response := &ChassisStatusResponse{}
-	if i.c == nil {
-		return false, fmt.Errorf("client is nil", zap.String("server", i.bmcEndpoint))
-	}
-	err := i.c.Send(request, response)
-	if err != nil {
+	if err := i.send(request, response); err != nil {
 		return false, err
 	}
 	if response.CompletionCode != CommandCompleted {
 		i.logger.Error("error getting chassis status", zap.Uint8("completion_code", uint8(response.CompletionCode)))
-		return false, fmt.Errorf("error getting chassis status")
+		return false, fmt.Errorf("%w: chassis status on server %s, completion code %#x", ErrCommandRejected,
+			i.bmcEndpoint, uint8(response.CompletionCode))
 	}
 	return response.IsSystemPowerOn(), nil
 }
@@ -91,10 +132,14 @@ func (i *IpmiServerSwitch) GetBmcEndpoint() string {
 
 // RetryConn will reopen a client connection if it is closed. It will close an existing connection if present.
 func (i *IpmiServerSwitch) RetryConn() error {
-	_ = i.c.Close()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.c != nil {
+		_ = i.c.Close()
+	}
 	client, err := open(*i.connection)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: server %s: %v", ErrBmcUnreachable, i.bmcEndpoint, err)
 	}
 	i.c = client
 	return nil
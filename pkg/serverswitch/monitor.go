@@ -0,0 +1,210 @@
+package serverswitch
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultMonitorInterval = 60 * time.Second
+
+const (
+	TemperatureInlet = "inlet"
+	TemperatureCpu   = "cpu"
+	TemperatureOther = "other"
+)
+
+var (
+	bmcTemperature = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bmc_temperature_celsius",
+		Help: "Temperature read from the BMC sensors, location is inlet, cpu or other",
+	}, []string{"node", "sensor", "location"})
+	bmcFanSpeed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bmc_fan_speed_rpm",
+		Help: "Fan speed read from the BMC sensors",
+	}, []string{"node", "sensor"})
+	bmcPsuOk = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bmc_psu_ok",
+		Help: "1 if the power supply is present with no failure nor input lost, 0 otherwise",
+	}, []string{"node", "sensor"})
+	bmcSelEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bmc_sel_entries",
+		Help: "Number of entries in the System Event Log",
+	}, []string{"node"})
+	bmcSelEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bmc_sel_events_total",
+		Help: "System events added to the System Event Log since target-exporter started",
+	}, []string{"node", "sensor_type"})
+)
+
+// Temperatures are the latest inlet and CPU temperatures of a node, the hottest sensor of each location is kept.
+type Temperatures struct {
+	Inlet    float64
+	Cpu      float64
+	HasInlet bool
+	HasCpu   bool
+	Time     time.Time
+}
+
+// Monitor polls the sensors and the System Event Log of the healthy BMCs of the pool and exports them as metrics.
+type Monitor struct {
+	pool     *Pool
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu              sync.Mutex
+	temperatures    map[string]Temperatures
+	lastSelAddition map[string]uint32
+}
+
+func NewMonitor(pool *Pool, interval time.Duration, logger *zap.Logger) *Monitor {
+	if interval <= 0 {
+		interval = DefaultMonitorInterval
+	}
+	return &Monitor{
+		pool:            pool,
+		interval:        interval,
+		logger:          logger.With(zap.String("component", "bmcmonitor")),
+		temperatures:    make(map[string]Temperatures),
+		lastSelAddition: make(map[string]uint32),
+	}
+}
+
+// Start polls the BMCs in the background until ctx is done.
+func (m *Monitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			m.poll()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Temperatures returns the latest temperatures read for the node, if any.
+func (m *Monitor) Temperatures(nodeName string) (Temperatures, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	temperatures, ok := m.temperatures[nodeName]
+	return temperatures, ok
+}
+
+func (m *Monitor) poll() {
+	for _, nodeName := range m.pool.NodeNames() {
+		srvSwitch, healthy := m.pool.Get(nodeName)
+		if !healthy {
+			continue
+		}
+		source, ok := srvSwitch.(SensorSource)
+		if !ok {
+			continue
+		}
+		if err := m.pollSensors(nodeName, source); err != nil {
+			m.logger.Error("error reading sensors", zap.String("nodeName", nodeName), zap.Error(err))
+			m.pool.ReportFailure(nodeName, err)
+			continue
+		}
+		if err := m.pollSel(nodeName, source); err != nil {
+			m.logger.Error("error reading system event log", zap.String("nodeName", nodeName), zap.Error(err))
+			m.pool.ReportFailure(nodeName, err)
+		}
+	}
+}
+
+func (m *Monitor) pollSensors(nodeName string, source SensorSource) error {
+	readings, err := source.Sensors()
+	if err != nil {
+		return err
+	}
+	temperatures := Temperatures{Time: time.Now()}
+	for _, reading := range readings {
+		if reading.Unavailable {
+			continue
+		}
+		switch reading.Type {
+		case SensorTypeTemperature:
+			if !reading.Analog {
+				continue
+			}
+			location := temperatureLocation(reading.Name)
+			bmcTemperature.WithLabelValues(nodeName, reading.Name, location).Set(reading.Value)
+			switch location {
+			case TemperatureInlet:
+				if !temperatures.HasInlet || reading.Value > temperatures.Inlet {
+					temperatures.Inlet, temperatures.HasInlet = reading.Value, true
+				}
+			case TemperatureCpu:
+				if !temperatures.HasCpu || reading.Value > temperatures.Cpu {
+					temperatures.Cpu, temperatures.HasCpu = reading.Value, true
+				}
+			}
+		case SensorTypeFan:
+			if reading.Analog {
+				bmcFanSpeed.WithLabelValues(nodeName, reading.Name).Set(reading.Value)
+			}
+		case SensorTypePowerSupply:
+			ok := reading.States&PsuStatePresent != 0 && reading.States&(PsuStateFailure|PsuStateInputLost) == 0
+			if ok {
+				bmcPsuOk.WithLabelValues(nodeName, reading.Name).Set(1)
+			} else {
+				bmcPsuOk.WithLabelValues(nodeName, reading.Name).Set(0)
+			}
+		}
+	}
+	m.mu.Lock()
+	m.temperatures[nodeName] = temperatures
+	m.mu.Unlock()
+	return nil
+}
+
+// pollSel counts and logs the system events added since the last poll, the events present at startup are skipped.
+func (m *Monitor) pollSel(nodeName string, source SensorSource) error {
+	info, err := source.SelInfo()
+	if err != nil {
+		return err
+	}
+	bmcSelEntries.WithLabelValues(nodeName).Set(float64(info.Entries))
+	m.mu.Lock()
+	last, seen := m.lastSelAddition[nodeName]
+	m.lastSelAddition[nodeName] = info.LastAddition
+	m.mu.Unlock()
+	if !seen || info.LastAddition == last || info.Entries == 0 {
+		return nil
+	}
+	events, err := source.SelEvents()
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if event.Timestamp <= last {
+			continue
+		}
+		bmcSelEvents.WithLabelValues(nodeName, event.SensorType.String()).Inc()
+		m.logger.Warn("new system event", zap.String("nodeName", nodeName), zap.Uint16("recordId", event.RecordId),
+			zap.String("sensorType", event.SensorType.String()), zap.Uint8("sensorNumber", event.SensorNumber),
+			zap.Bool("deassertion", event.Deassertion))
+	}
+	return nil
+}
+
+// temperatureLocation guesses where a temperature sensor is from its name, as reported by the BMC.
+func temperatureLocation(sensorName string) string {
+	name := strings.ToLower(sensorName)
+	switch {
+	case strings.Contains(name, "inlet") || strings.Contains(name, "ambient"):
+		return TemperatureInlet
+	case strings.Contains(name, "cpu") || strings.Contains(name, "proc"):
+		return TemperatureCpu
+	default:
+		return TemperatureOther
+	}
+}
@@ -0,0 +1,217 @@
+package serverswitch
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinReconnectBackoff = 5 * time.Second
+	DefaultMaxReconnectBackoff = 5 * time.Minute
+	poolCheckInterval          = 1 * time.Second
+)
+
+type BmcHealth string
+
+const (
+	BmcHealthy    BmcHealth = "healthy"
+	BmcUnhealthy  BmcHealth = "unhealthy"
+	BmcConnecting BmcHealth = "connecting" // never connected yet
+)
+
+// SwitchFactory creates the server switch of a BMC, connecting to it.
+type SwitchFactory func() (ServerSwitch, error)
+
+// BmcStatus is the health of the connection to a BMC.
+type BmcStatus struct {
+	NodeName  string    `json:"nodeName"`
+	Endpoint  string    `json:"endpoint"`
+	Health    BmcHealth `json:"health"`
+	LastError string    `json:"lastError,omitempty"`
+	Failures  int       `json:"failures"`
+	NextRetry time.Time `json:"nextRetry,omitempty"`
+}
+
+type poolEntry struct {
+	status    BmcStatus
+	factory   SwitchFactory
+	srvSwitch ServerSwitch
+}
+
+type PoolOption func(*Pool)
+
+// ReconnectBackoff sets the delay before the first reconnection attempt to an unhealthy BMC, doubled after each
+// failure up to max.
+func ReconnectBackoff(min, max time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.minBackoff = min
+		p.maxBackoff = max
+	}
+}
+
+// Pool manages the connections to the BMCs of the servers. BMCs that cannot be reached, at boot or later, are marked
+// unhealthy and reconnected in the background with exponential backoff, so that callers never block on them.
+type Pool struct {
+	mu         sync.Mutex
+	entries    map[string]*poolEntry
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	logger     *zap.Logger
+}
+
+func NewPool(logger *zap.Logger, options ...PoolOption) *Pool {
+	p := &Pool{
+		entries:    make(map[string]*poolEntry),
+		minBackoff: DefaultMinReconnectBackoff,
+		maxBackoff: DefaultMaxReconnectBackoff,
+		logger:     logger.With(zap.String("component", "bmcpool")),
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// Add registers the BMC of a node, the connection is established by the background loop.
+func (p *Pool) Add(nodeName, endpoint string, factory SwitchFactory) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries[nodeName] = &poolEntry{
+		status:  BmcStatus{NodeName: nodeName, Endpoint: endpoint, Health: BmcConnecting, NextRetry: time.Now()},
+		factory: factory,
+	}
+}
+
+// Start connects and reconnects the BMCs in the background until ctx is done.
+func (p *Pool) Start(ctx context.Context) {
+	go func() {
+		p.reconnect()
+		ticker := time.NewTicker(poolCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.reconnect()
+			}
+		}
+	}()
+}
+
+// Get returns the server switch of a node if its BMC is healthy.
+func (p *Pool) Get(nodeName string) (ServerSwitch, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.entries[nodeName]
+	if !ok || entry.status.Health != BmcHealthy {
+		return nil, false
+	}
+	return entry.srvSwitch, true
+}
+
+// Has returns whether the node has a BMC, healthy or not.
+func (p *Pool) Has(nodeName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.entries[nodeName]
+	return ok
+}
+
+// ReportFailure marks the BMC of a node unhealthy if err means it could not be reached, so that it is reconnected in
+// the background. Other errors, e.g. rejected commands, do not affect the connection.
+func (p *Pool) ReportFailure(nodeName string, err error) {
+	if !errors.Is(err, ErrBmcUnreachable) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.entries[nodeName]
+	if !ok || entry.status.Health != BmcHealthy {
+		return
+	}
+	p.logger.Warn("bmc unreachable, reconnecting in background", zap.String("nodeName", nodeName), zap.Error(err))
+	entry.status.Health = BmcUnhealthy
+	entry.status.LastError = err.Error()
+	entry.status.NextRetry = time.Now()
+}
+
+// NodeNames returns the sorted names of the nodes with a BMC.
+func (p *Pool) NodeNames() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.entries))
+	for nodeName := range p.entries {
+		names = append(names, nodeName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Statuses returns the health of every BMC, sorted by node name.
+func (p *Pool) Statuses() []BmcStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	statuses := make([]BmcStatus, 0, len(p.entries))
+	for _, entry := range p.entries {
+		statuses = append(statuses, entry.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].NodeName < statuses[j].NodeName
+	})
+	return statuses
+}
+
+// reconnect tries to connect the unhealthy BMCs whose backoff expired, outside the lock as it may take a while.
+func (p *Pool) reconnect() {
+	p.mu.Lock()
+	due := make(map[string]*poolEntry)
+	for nodeName, entry := range p.entries {
+		if entry.status.Health != BmcHealthy && !time.Now().Before(entry.status.NextRetry) {
+			due[nodeName] = entry
+		}
+	}
+	p.mu.Unlock()
+
+	for nodeName, entry := range due {
+		var err error
+		srvSwitch := entry.srvSwitch
+		if srvSwitch == nil {
+			srvSwitch, err = entry.factory()
+		} else {
+			err = srvSwitch.RetryConn()
+		}
+
+		p.mu.Lock()
+		if err != nil {
+			entry.status.Failures++
+			entry.status.LastError = err.Error()
+			entry.status.NextRetry = time.Now().Add(p.backoff(entry.status.Failures))
+			p.logger.Warn("failed to connect to bmc", zap.String("nodeName", nodeName), zap.Error(err),
+				zap.Int("failures", entry.status.Failures), zap.Time("nextRetry", entry.status.NextRetry))
+		} else {
+			entry.srvSwitch = srvSwitch
+			entry.status.Health = BmcHealthy
+			entry.status.Failures = 0
+			entry.status.LastError = ""
+			entry.status.NextRetry = time.Time{}
+			p.logger.Info("connected to bmc", zap.String("nodeName", nodeName))
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Pool) backoff(failures int) time.Duration {
+	backoff := p.minBackoff
+	for i := 1; i < failures && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	return backoff
+}
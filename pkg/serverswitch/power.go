@@ -0,0 +1,55 @@
+package serverswitch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrBmcUnreachable is returned when the BMC could not be contacted, e.g. network errors or a closed session.
+	ErrBmcUnreachable = errors.New("bmc unreachable")
+	// ErrCommandRejected is returned when the BMC answered but refused or failed to execute the command.
+	ErrCommandRejected = errors.New("bmc command rejected")
+	// ErrPowerStateTimeout is returned when a server does not reach the expected power state in time.
+	ErrPowerStateTimeout = errors.New("timeout waiting for power state")
+)
+
+const (
+	DefaultPowerStateTimeout  = 5 * time.Minute
+	DefaultPowerStateInterval = 5 * time.Second
+)
+
+// WaitForPowerState polls the server until it is on (or off, depending on on) or until timeout expires. Errors
+// reading the power state are tolerated while waiting, since BMCs may briefly stop answering during power changes;
+// the last one is reported if the state is never reached. It stops waiting when ctx is done.
+func WaitForPowerState(ctx context.Context, s ServerSwitch, on bool, timeout, interval time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultPowerStateTimeout
+	}
+	if interval <= 0 {
+		interval = DefaultPowerStateInterval
+	}
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		isOn, err := s.IsServerOn()
+		if err == nil && isOn == on {
+			return nil
+		}
+		lastErr = err
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%w (on=%t) for server %s: %v", ErrPowerStateTimeout, on, s.GetBmcEndpoint(), lastErr)
+	}
+	return fmt.Errorf("%w (on=%t) for server %s", ErrPowerStateTimeout, on, s.GetBmcEndpoint())
+}
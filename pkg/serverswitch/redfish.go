@@ -0,0 +1,184 @@
+package serverswitch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RedfishResetOn               = "On"
+	RedfishResetGracefulShutdown = "GracefulShutdown"
+	RedfishResetForceOff         = "ForceOff"
+
+	redfishSystemsPath    = "/redfish/v1/Systems"
+	redfishPowerStateOn   = "On"
+	redfishRequestTimeout = 10 * time.Second
+)
+
+type redfishCollection struct {
+	Members []struct {
+		OdataId string `json:"@odata.id"`
+	} `json:"Members"`
+}
+
+type redfishSystem struct {
+	PowerState string `json:"PowerState"`
+	Actions    struct {
+		Reset struct {
+			Target string `json:"target"`
+		} `json:"#ComputerSystem.Reset"`
+	} `json:"Actions"`
+}
+
+// RedfishServerSwitch switches a server on and off through the ComputerSystem.Reset action of its BMC Redfish API.
+type RedfishServerSwitch struct {
+	bmcEndpoint string
+	baseUrl     string
+	username    string
+	password    string
+	httpClient  *http.Client
+	systemPath  string
+	logger      *zap.Logger
+}
+
+// NewRedfishServerSwitch creates a switch for the first ComputerSystem exposed by the BMC. The endpoint can be a host
+// (HTTPS is assumed) or a URL, e.g. http://localhost:8000 for a local mock Redfish server.
+func NewRedfishServerSwitch(endpoint, username, password string, insecureSkipVerify bool, logger *zap.Logger) (*RedfishServerSwitch, error) {
+	baseUrl := endpoint
+	if !strings.HasPrefix(baseUrl, "http://") && !strings.HasPrefix(baseUrl, "https://") {
+		baseUrl = "https://" + baseUrl
+	}
+	r := &RedfishServerSwitch{
+		bmcEndpoint: endpoint,
+		baseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		username:    username,
+		password:    password,
+		httpClient: &http.Client{
+			Timeout: redfishRequestTimeout,
+			Transport: &http.Transport{
+				// BMCs commonly ship with self-signed certificates
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			},
+		},
+		logger: logger.With(zap.String("server", endpoint)),
+	}
+	if err := r.RetryConn(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// PowerOn powers the server on.
+func (r *RedfishServerSwitch) PowerOn() error {
+	return r.reset(RedfishResetOn)
+}
+
+// PowerOff asks the operating system to shut down gracefully.
+func (r *RedfishServerSwitch) PowerOff() error {
+	return r.reset(RedfishResetGracefulShutdown)
+}
+
+// ForceOff cuts the power of the server immediately.
+func (r *RedfishServerSwitch) ForceOff() error {
+	return r.reset(RedfishResetForceOff)
+}
+
+func (r *RedfishServerSwitch) IsServerOn() (bool, error) {
+	system, err := r.getSystem()
+	if err != nil {
+		return false, err
+	}
+	return system.PowerState == redfishPowerStateOn, nil
+}
+
+func (r *RedfishServerSwitch) GetBmcEndpoint() string {
+	return r.bmcEndpoint
+}
+
+// RetryConn discovers again the ComputerSystem managed by the BMC.
+func (r *RedfishServerSwitch) RetryConn() error {
+	var systems redfishCollection
+	if err := r.do(http.MethodGet, redfishSystemsPath, nil, &systems); err != nil {
+		return err
+	}
+	if len(systems.Members) == 0 {
+		return fmt.Errorf("no ComputerSystem found on BMC %s", r.bmcEndpoint)
+	}
+	r.systemPath = systems.Members[0].OdataId
+	return nil
+}
+
+func (r *RedfishServerSwitch) getSystem() (*redfishSystem, error) {
+	if r.systemPath == "" {
+		return nil, fmt.Errorf("no ComputerSystem discovered for server %s", r.bmcEndpoint)
+	}
+	system := &redfishSystem{}
+	if err := r.do(http.MethodGet, r.systemPath, nil, system); err != nil {
+		return nil, err
+	}
+	return system, nil
+}
+
+func (r *RedfishServerSwitch) reset(resetType string) error {
+	system, err := r.getSystem()
+	if err != nil {
+		return err
+	}
+	target := system.Actions.Reset.Target
+	if target == "" {
+		target = r.systemPath + "/Actions/ComputerSystem.Reset"
+	}
+	if err = r.do(http.MethodPost, target, map[string]string{"ResetType": resetType}, nil); err != nil {
+		r.logger.Error("error sending reset command", zap.String("resetType", resetType), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// do sends a request to the BMC and decodes the JSON response into out, if not nil.
+func (r *RedfishServerSwitch) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redfishRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, r.baseUrl+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(r.username, r.password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBmcUnreachable, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBmcUnreachable, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: redfish %s %s returned status %d: %s", ErrCommandRejected, method, path,
+			resp.StatusCode, string(respBody))
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,190 @@
+package serverswitch
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+const (
+	testUsername   = "admin"
+	testPassword   = "secret"
+	testSystemPath = "/redfish/v1/Systems/1"
+	testResetPath  = "/redfish/v1/Systems/1/Actions/ComputerSystem.Reset"
+)
+
+// fakeBmc is a minimal Redfish service exposing a single ComputerSystem.
+type fakeBmc struct {
+	mu         sync.Mutex
+	powerState string
+	resets     []string
+	rejectAll  bool
+}
+
+func (b *fakeBmc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != testUsername || password != testPassword {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == redfishSystemsPath:
+		writeJson(w, map[string]interface{}{
+			"Members": []map[string]string{{"@odata.id": testSystemPath}},
+		})
+	case r.Method == http.MethodGet && r.URL.Path == testSystemPath:
+		writeJson(w, map[string]interface{}{
+			"PowerState": b.powerState,
+			"Actions": map[string]interface{}{
+				"#ComputerSystem.Reset": map[string]string{"target": testResetPath},
+			},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == testResetPath:
+		if b.rejectAll {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			ResetType string `json:"ResetType"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.resets = append(b.resets, body.ResetType)
+		switch body.ResetType {
+		case RedfishResetOn:
+			b.powerState = "On"
+		case RedfishResetGracefulShutdown, RedfishResetForceOff:
+			b.powerState = "Off"
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (b *fakeBmc) lastReset() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.resets) == 0 {
+		return ""
+	}
+	return b.resets[len(b.resets)-1]
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newTestRedfishSwitch(t *testing.T, bmc *fakeBmc) *RedfishServerSwitch {
+	t.Helper()
+	server := httptest.NewServer(bmc)
+	t.Cleanup(server.Close)
+	s, err := NewRedfishServerSwitch(server.URL, testUsername, testPassword, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("error creating redfish switch: %s", err)
+	}
+	return s
+}
+
+func TestRedfishPowerState(t *testing.T) {
+	bmc := &fakeBmc{powerState: "Off"}
+	s := newTestRedfishSwitch(t, bmc)
+	if s.systemPath != testSystemPath {
+		t.Fatalf("discovered system %q, want %q", s.systemPath, testSystemPath)
+	}
+	on, err := s.IsServerOn()
+	if err != nil || on {
+		t.Fatalf("IsServerOn() = %t, %v, want false", on, err)
+	}
+	bmc.mu.Lock()
+	bmc.powerState = "On"
+	bmc.mu.Unlock()
+	on, err = s.IsServerOn()
+	if err != nil || !on {
+		t.Fatalf("IsServerOn() = %t, %v, want true", on, err)
+	}
+}
+
+func TestRedfishPowerTransitions(t *testing.T) {
+	bmc := &fakeBmc{powerState: "Off"}
+	s := newTestRedfishSwitch(t, bmc)
+	tests := []struct {
+		name      string
+		action    func() error
+		resetType string
+		on        bool
+	}{
+		{"power on", s.PowerOn, RedfishResetOn, true},
+		{"graceful off", s.PowerOff, RedfishResetGracefulShutdown, false},
+		{"power on again", s.PowerOn, RedfishResetOn, true},
+		{"force off", s.ForceOff, RedfishResetForceOff, false},
+	}
+	for _, tt := range tests {
+		if err := tt.action(); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if reset := bmc.lastReset(); reset != tt.resetType {
+			t.Fatalf("%s: sent ResetType %q, want %q", tt.name, reset, tt.resetType)
+		}
+		if on, err := s.IsServerOn(); err != nil || on != tt.on {
+			t.Fatalf("%s: IsServerOn() = %t, %v, want %t", tt.name, on, err, tt.on)
+		}
+	}
+}
+
+func TestRedfishCommandRejected(t *testing.T) {
+	bmc := &fakeBmc{powerState: "On"}
+	s := newTestRedfishSwitch(t, bmc)
+	bmc.mu.Lock()
+	bmc.rejectAll = true
+	bmc.mu.Unlock()
+	if err := s.PowerOff(); !errors.Is(err, ErrCommandRejected) {
+		t.Fatalf("PowerOff() = %v, want %v", err, ErrCommandRejected)
+	}
+}
+
+func TestRedfishAuthError(t *testing.T) {
+	server := httptest.NewServer(&fakeBmc{powerState: "On"})
+	defer server.Close()
+	_, err := NewRedfishServerSwitch(server.URL, testUsername, "wrong", false, zap.NewNop())
+	if !errors.Is(err, ErrCommandRejected) {
+		t.Fatalf("NewRedfishServerSwitch() with wrong password = %v, want %v", err, ErrCommandRejected)
+	}
+}
+
+func TestRedfishTls(t *testing.T) {
+	server := httptest.NewTLSServer(&fakeBmc{powerState: "On"})
+	defer server.Close()
+
+	// The test server certificate is self-signed, like most BMCs
+	if _, err := NewRedfishServerSwitch(server.URL, testUsername, testPassword, false, zap.NewNop()); !errors.Is(err, ErrBmcUnreachable) {
+		t.Fatalf("NewRedfishServerSwitch() verifying a self-signed certificate = %v, want %v", err, ErrBmcUnreachable)
+	}
+	s, err := NewRedfishServerSwitch(server.URL, testUsername, testPassword, true, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewRedfishServerSwitch() skipping verification: %s", err)
+	}
+	if on, err := s.IsServerOn(); err != nil || !on {
+		t.Fatalf("IsServerOn() = %t, %v, want true", on, err)
+	}
+}
+
+func TestRedfishUnreachable(t *testing.T) {
+	server := httptest.NewServer(&fakeBmc{powerState: "On"})
+	s, err := NewRedfishServerSwitch(server.URL, testUsername, testPassword, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("error creating redfish switch: %s", err)
+	}
+	server.Close()
+	if _, err = s.IsServerOn(); !errors.Is(err, ErrBmcUnreachable) {
+		t.Fatalf("IsServerOn() on a closed server = %v, want %v", err, ErrBmcUnreachable)
+	}
+}
@@ -0,0 +1,370 @@
+package serverswitch
+
+import (
+	"encoding/binary"
+	"fmt"
+	. "github.com/vmware/goipmi"
+	"math"
+	"strings"
+)
+
+// goipmi only implements chassis and user commands, the sensor and storage commands below are sent as raw requests.
+var (
+	NetworkFunctionSensorEvent = NetworkFunction(0x04)
+	NetworkFunctionStorage     = NetworkFunction(0x0a)
+)
+
+const (
+	CommandGetSensorReading     = Command(0x2d)
+	CommandReserveSdrRepository = Command(0x22)
+	CommandGetSdr               = Command(0x23)
+	CommandGetSelInfo           = Command(0x40)
+	CommandGetSelEntry          = Command(0x43)
+	sdrHeaderSize               = 5
+	sdrReadChunk                = 16
+	sdrRecordTypeFullSensor     = 0x01
+	sdrRecordTypeCompactSensor  = 0x02
+	selRecordTypeSystemEvent    = 0x02
+	sensorReadingUnavailable    = 0x20
+	sensorAnalogFormatNotAnalog = 0x03
+	sensorLinearizationLinear   = 0x00
+	lastRecordId                = 0xffff
+	selEntrySize                = 16
+	selEntryReadAll             = 0xff
+)
+
+type SensorType uint8
+
+const (
+	SensorTypeTemperature = SensorType(0x01)
+	SensorTypeFan         = SensorType(0x04)
+	SensorTypePowerSupply = SensorType(0x08)
+)
+
+func (t SensorType) String() string {
+	switch t {
+	case SensorTypeTemperature:
+		return "temperature"
+	case SensorTypeFan:
+		return "fan"
+	case SensorTypePowerSupply:
+		return "power_supply"
+	default:
+		return "other"
+	}
+}
+
+// Power supply sensor-specific states, IPMI spec table 42-3
+const (
+	PsuStatePresent    = 1 << 0
+	PsuStateFailure    = 1 << 1
+	PsuStatePredictive = 1 << 2
+	PsuStateInputLost  = 1 << 3
+)
+
+// SensorReading is the current value of a sensor. Analog sensors (temperatures, fans) have a Value in their unit,
+// discrete sensors (e.g. power supplies) have their asserted States.
+type SensorReading struct {
+	Name        string
+	Type        SensorType
+	Analog      bool
+	Value       float64
+	States      uint16
+	Unavailable bool
+}
+
+// SelInfo summarizes the System Event Log.
+type SelInfo struct {
+	Entries      uint16
+	LastAddition uint32 // timestamp of the most recent entry
+}
+
+// SelEvent is a system event from the System Event Log.
+type SelEvent struct {
+	RecordId     uint16
+	Timestamp    uint32
+	SensorType   SensorType
+	SensorNumber uint8
+	Deassertion  bool
+	EventData    [3]uint8
+}
+
+// SensorSource is implemented by server switches able to read sensors and the System Event Log of the BMC.
+type SensorSource interface {
+	Sensors() ([]SensorReading, error)
+	SelInfo() (SelInfo, error)
+	SelEvents() ([]SelEvent, error)
+}
+
+type sdrSensor struct {
+	name             string
+	number           uint8
+	sensorType       SensorType
+	analog           bool
+	signedFormat     uint8
+	m, b             int
+	rExp, bExp       int
+	eventReadingType uint8
+}
+
+type rawRequest struct {
+	data []byte
+}
+
+func (r *rawRequest) MarshalBinary() ([]byte, error) {
+	return r.data, nil
+}
+
+type rawResponse struct {
+	CompletionCode
+	data []byte
+}
+
+func (r *rawResponse) UnmarshalBinary(buf []byte) error {
+	if len(buf) == 0 {
+		return ErrShortPacket
+	}
+	r.CompletionCode = CompletionCode(buf[0])
+	r.data = buf[1:]
+	return nil
+}
+
+// raw sends a command goipmi has no type for and returns the response data after the completion code.
+func (i *IpmiServerSwitch) raw(netFn NetworkFunction, command Command, data ...byte) ([]byte, error) {
+	response := &rawResponse{}
+	if err := i.send(&Request{NetworkFunction: netFn, Command: command, Data: &rawRequest{data: data}}, response); err != nil {
+		return nil, err
+	}
+	if response.CompletionCode != CommandCompleted {
+		return nil, fmt.Errorf("%w: command %#x on server %s, completion code %#x", ErrCommandRejected, uint8(command),
+			i.bmcEndpoint, uint8(response.CompletionCode))
+	}
+	return response.data, nil
+}
+
+// Sensors reads the temperature, fan and power supply sensors. The Sensor Data Records describing the sensors are
+// read once and cached.
+func (i *IpmiServerSwitch) Sensors() ([]SensorReading, error) {
+	if i.sdr == nil {
+		sdr, err := i.readSdr()
+		if err != nil {
+			return nil, err
+		}
+		i.sdr = sdr
+	}
+	readings := make([]SensorReading, 0, len(i.sdr))
+	for _, sensor := range i.sdr {
+		data, err := i.raw(NetworkFunctionSensorEvent, CommandGetSensorReading, sensor.number)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 2 {
+			return nil, fmt.Errorf("short sensor reading for sensor %s", sensor.name)
+		}
+		reading := SensorReading{
+			Name:        sensor.name,
+			Type:        sensor.sensorType,
+			Analog:      sensor.analog,
+			Unavailable: data[1]&sensorReadingUnavailable != 0,
+		}
+		if sensor.analog {
+			reading.Value = sensor.convert(data[0])
+		}
+		if len(data) >= 3 {
+			reading.States = uint16(data[2])
+		}
+		if len(data) >= 4 {
+			reading.States |= uint16(data[3]&0x7f) << 8
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+// SelInfo reads the number of entries and the time of the most recent addition to the System Event Log.
+func (i *IpmiServerSwitch) SelInfo() (SelInfo, error) {
+	data, err := i.raw(NetworkFunctionStorage, CommandGetSelInfo)
+	if err != nil {
+		return SelInfo{}, err
+	}
+	if len(data) < 9 {
+		return SelInfo{}, fmt.Errorf("short SEL info response")
+	}
+	return SelInfo{
+		Entries:      binary.LittleEndian.Uint16(data[1:3]),
+		LastAddition: binary.LittleEndian.Uint32(data[5:9]),
+	}, nil
+}
+
+// SelEvents reads all the system events of the System Event Log.
+func (i *IpmiServerSwitch) SelEvents() ([]SelEvent, error) {
+	events := make([]SelEvent, 0)
+	recordId := uint16(0)
+	for recordId != lastRecordId {
+		request := make([]byte, 6)
+		binary.LittleEndian.PutUint16(request[2:4], recordId)
+		request[5] = selEntryReadAll
+		data, err := i.raw(NetworkFunctionStorage, CommandGetSelEntry, request...)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 2+selEntrySize {
+			return nil, fmt.Errorf("short SEL entry response")
+		}
+		recordId = binary.LittleEndian.Uint16(data[0:2])
+		record := data[2:]
+		if record[2] != selRecordTypeSystemEvent {
+			continue
+		}
+		events = append(events, SelEvent{
+			RecordId:     binary.LittleEndian.Uint16(record[0:2]),
+			Timestamp:    binary.LittleEndian.Uint32(record[3:7]),
+			SensorType:   SensorType(record[10]),
+			SensorNumber: record[11],
+			Deassertion:  record[12]&0x80 != 0,
+			EventData:    [3]uint8{record[13], record[14], record[15]},
+		})
+	}
+	return events, nil
+}
+
+// readSdr reads the Sensor Data Records of the temperature, fan and power supply sensors.
+func (i *IpmiServerSwitch) readSdr() ([]sdrSensor, error) {
+	reservation, err := i.reserveSdr()
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]sdrSensor, 0)
+	recordId := uint16(0)
+	for recordId != lastRecordId {
+		nextId, header, err := i.getSdr(reservation, recordId, 0, sdrHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) < sdrHeaderSize {
+			return nil, fmt.Errorf("short SDR header for record %d", recordId)
+		}
+		record := header
+		for offset := sdrHeaderSize; offset < sdrHeaderSize+int(header[4]); offset += sdrReadChunk {
+			count := sdrHeaderSize + int(header[4]) - offset
+			if count > sdrReadChunk {
+				count = sdrReadChunk
+			}
+			_, chunk, err := i.getSdr(reservation, recordId, uint8(offset), uint8(count))
+			if err != nil {
+				return nil, err
+			}
+			record = append(record, chunk...)
+		}
+		if sensor, ok := parseSdrSensor(record); ok {
+			sensors = append(sensors, sensor)
+		}
+		recordId = nextId
+	}
+	return sensors, nil
+}
+
+func (i *IpmiServerSwitch) reserveSdr() (uint16, error) {
+	data, err := i.raw(NetworkFunctionStorage, CommandReserveSdrRepository)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < 2 {
+		return 0, fmt.Errorf("short SDR reservation response")
+	}
+	return binary.LittleEndian.Uint16(data), nil
+}
+
+func (i *IpmiServerSwitch) getSdr(reservation, recordId uint16, offset, count uint8) (uint16, []byte, error) {
+	request := make([]byte, 6)
+	binary.LittleEndian.PutUint16(request[0:2], reservation)
+	binary.LittleEndian.PutUint16(request[2:4], recordId)
+	request[4] = offset
+	request[5] = count
+	data, err := i.raw(NetworkFunctionStorage, CommandGetSdr, request...)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 2 {
+		return 0, nil, fmt.Errorf("short SDR response for record %d", recordId)
+	}
+	return binary.LittleEndian.Uint16(data[0:2]), data[2:], nil
+}
+
+// parseSdrSensor parses full and compact sensor records, keeping only temperature, fan and power supply sensors.
+func parseSdrSensor(record []byte) (sdrSensor, bool) {
+	if len(record) < sdrHeaderSize {
+		return sdrSensor{}, false
+	}
+	var sensor sdrSensor
+	switch record[3] {
+	case sdrRecordTypeFullSensor:
+		if len(record) < 48 {
+			return sdrSensor{}, false
+		}
+		sensor = sdrSensor{
+			number:           record[7],
+			sensorType:       SensorType(record[12]),
+			eventReadingType: record[13],
+			signedFormat:     record[20] >> 6,
+			m:                toSigned(int(record[24])|int(record[25]&0xc0)<<2, 10),
+			b:                toSigned(int(record[26])|int(record[27]&0xc0)<<2, 10),
+			rExp:             toSigned(int(record[29]>>4), 4),
+			bExp:             toSigned(int(record[29]&0x0f), 4),
+			name:             sdrName(record, 47),
+		}
+		sensor.analog = sensor.signedFormat != sensorAnalogFormatNotAnalog &&
+			record[23]&0x7f == sensorLinearizationLinear
+	case sdrRecordTypeCompactSensor:
+		if len(record) < 32 {
+			return sdrSensor{}, false
+		}
+		sensor = sdrSensor{
+			number:           record[7],
+			sensorType:       SensorType(record[12]),
+			eventReadingType: record[13],
+			name:             sdrName(record, 31),
+		}
+	default:
+		return sdrSensor{}, false
+	}
+	switch sensor.sensorType {
+	case SensorTypeTemperature, SensorTypeFan, SensorTypePowerSupply:
+		return sensor, true
+	default:
+		return sdrSensor{}, false
+	}
+}
+
+func sdrName(record []byte, lengthOffset int) string {
+	length := int(record[lengthOffset] & 0x1f)
+	start := lengthOffset + 1
+	if start+length > len(record) {
+		length = len(record) - start
+	}
+	return strings.TrimRight(string(record[start:start+length]), "\x00 ")
+}
+
+// convert converts a raw reading of a linear analog sensor: y = (M*x + B*10^Bexp) * 10^Rexp.
+func (s sdrSensor) convert(raw uint8) float64 {
+	var x int
+	switch s.signedFormat {
+	case 0x01: // 1's complement
+		x = int(int8(raw))
+		if x < 0 {
+			x++
+		}
+	case 0x02: // 2's complement
+		x = int(int8(raw))
+	default:
+		x = int(raw)
+	}
+	return (float64(s.m*x) + float64(s.b)*math.Pow10(s.bExp)) * math.Pow10(s.rExp)
+}
+
+func toSigned(value int, bits uint) int {
+	if value&(1<<(bits-1)) != 0 {
+		return value - (1 << bits)
+	}
+	return value
+}
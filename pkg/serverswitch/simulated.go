@@ -0,0 +1,145 @@
+package serverswitch
+
+import (
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSimulatedBootDelay     = 30 * time.Second
+	DefaultSimulatedShutdownDelay = 10 * time.Second
+)
+
+// NodeTainter taints the Kubernetes node of a simulated server while it is off, so that the node looks gone to the
+// scheduler and its pods are evicted.
+type NodeTainter interface {
+	TaintNodePoweredOff(nodeName string) error
+	UntaintNodePoweredOff(nodeName string) error
+}
+
+type SimulatedServerSwitchOption func(*SimulatedServerSwitch)
+
+// BootDelay sets how long the simulated server takes to be on after PowerOn.
+func BootDelay(delay time.Duration) SimulatedServerSwitchOption {
+	return func(s *SimulatedServerSwitch) {
+		s.bootDelay = delay
+	}
+}
+
+// ShutdownDelay sets how long the simulated server takes to be off after a graceful PowerOff.
+func ShutdownDelay(delay time.Duration) SimulatedServerSwitchOption {
+	return func(s *SimulatedServerSwitch) {
+		s.shutdownDelay = delay
+	}
+}
+
+// TaintNode taints the node while the simulated server is off.
+func TaintNode(tainter NodeTainter) SimulatedServerSwitchOption {
+	return func(s *SimulatedServerSwitch) {
+		s.tainter = tainter
+	}
+}
+
+// SimulatedServerSwitch is an in-memory ServerSwitch for testing and demos, e.g. on kind clusters. Servers start
+// powered on and change state after the configured boot and shutdown delays.
+type SimulatedServerSwitch struct {
+	nodeName      string
+	bmcEndpoint   string
+	bootDelay     time.Duration
+	shutdownDelay time.Duration
+	tainter       NodeTainter
+	logger        *zap.Logger
+
+	mu         sync.Mutex
+	on         bool
+	transition *time.Timer
+	// generation identifies the latest transition, so that a replaced timer which already fired does not apply
+	generation uint64
+}
+
+func NewSimulatedServerSwitch(nodeName, endpoint string, logger *zap.Logger, options ...SimulatedServerSwitchOption) *SimulatedServerSwitch {
+	s := &SimulatedServerSwitch{
+		nodeName:      nodeName,
+		bmcEndpoint:   endpoint,
+		bootDelay:     DefaultSimulatedBootDelay,
+		shutdownDelay: DefaultSimulatedShutdownDelay,
+		logger:        logger.With(zap.String("server", endpoint), zap.String("nodeName", nodeName)),
+		on:            true,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+func (s *SimulatedServerSwitch) PowerOn() error {
+	s.logger.Info("simulating power on", zap.Duration("bootDelay", s.bootDelay))
+	s.changeState(true, s.bootDelay)
+	return nil
+}
+
+func (s *SimulatedServerSwitch) PowerOff() error {
+	s.logger.Info("simulating soft power off", zap.Duration("shutdownDelay", s.shutdownDelay))
+	s.changeState(false, s.shutdownDelay)
+	return nil
+}
+
+func (s *SimulatedServerSwitch) ForceOff() error {
+	s.logger.Info("simulating hard power off")
+	s.changeState(false, 0)
+	return nil
+}
+
+func (s *SimulatedServerSwitch) IsServerOn() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.on, nil
+}
+
+func (s *SimulatedServerSwitch) GetBmcEndpoint() string {
+	return s.bmcEndpoint
+}
+
+func (s *SimulatedServerSwitch) RetryConn() error {
+	return nil
+}
+
+// changeState sets the power state after delay, replacing any transition in progress.
+func (s *SimulatedServerSwitch) changeState(on bool, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transition != nil {
+		s.transition.Stop()
+	}
+	s.generation++
+	generation := s.generation
+	s.transition = time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.generation != generation {
+			return
+		}
+		s.on = on
+		s.transition = nil
+		s.logger.Info("simulated server power state changed", zap.Bool("isOn", on))
+		s.updateTaint(on)
+	})
+}
+
+// updateTaint taints or untaints the node. It is called with the lock held so that taints follow the order of the
+// transitions.
+func (s *SimulatedServerSwitch) updateTaint(on bool) {
+	if s.tainter == nil {
+		return
+	}
+	var err error
+	if on {
+		err = s.tainter.UntaintNodePoweredOff(s.nodeName)
+	} else {
+		err = s.tainter.TaintNodePoweredOff(s.nodeName)
+	}
+	if err != nil {
+		s.logger.Error("error updating node taint", zap.Bool("isOn", on), zap.Error(err))
+	}
+}
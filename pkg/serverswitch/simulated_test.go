@@ -0,0 +1,191 @@
+package serverswitch
+
+import (
+	"encoding/json"
+	"git.helio.dev/eco-qube/target-exporter/pkg/kubeclient"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testNodeName = "node-1"
+
+// fakeTainter records the taint of each node.
+type fakeTainter struct {
+	mu      sync.Mutex
+	tainted map[string]bool
+	calls   int
+}
+
+func (f *fakeTainter) TaintNodePoweredOff(nodeName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tainted[nodeName] = true
+	f.calls++
+	return nil
+}
+
+func (f *fakeTainter) UntaintNodePoweredOff(nodeName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tainted[nodeName] = false
+	f.calls++
+	return nil
+}
+
+func (f *fakeTainter) isTainted(nodeName string) (bool, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tainted[nodeName], f.calls
+}
+
+// eventually fails the test if cond is not true within a second.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func isOn(s *SimulatedServerSwitch) bool {
+	on, _ := s.IsServerOn()
+	return on
+}
+
+func TestSimulatedPowerTransitions(t *testing.T) {
+	tainter := &fakeTainter{tainted: make(map[string]bool)}
+	s := NewSimulatedServerSwitch(testNodeName, "sim-1", zap.NewNop(), BootDelay(20*time.Millisecond),
+		ShutdownDelay(20*time.Millisecond), TaintNode(tainter))
+	if !isOn(s) {
+		t.Fatal("simulated server does not start powered on")
+	}
+
+	if err := s.PowerOff(); err != nil {
+		t.Fatalf("PowerOff() = %v", err)
+	}
+	if !isOn(s) {
+		t.Fatal("simulated server off before its shutdown delay")
+	}
+	eventually(t, func() bool { return !isOn(s) }, "simulated server not off after its shutdown delay")
+	if tainted, _ := tainter.isTainted(testNodeName); !tainted {
+		t.Fatal("node not tainted once the server is off")
+	}
+
+	if err := s.PowerOn(); err != nil {
+		t.Fatalf("PowerOn() = %v", err)
+	}
+	if isOn(s) {
+		t.Fatal("simulated server on before its boot delay")
+	}
+	eventually(t, func() bool { return isOn(s) }, "simulated server not on after its boot delay")
+	if tainted, _ := tainter.isTainted(testNodeName); tainted {
+		t.Fatal("node still tainted once the server is on")
+	}
+
+	if err := s.ForceOff(); err != nil {
+		t.Fatalf("ForceOff() = %v", err)
+	}
+	eventually(t, func() bool { return !isOn(s) }, "simulated server not off after ForceOff")
+	eventually(t, func() bool { tainted, _ := tainter.isTainted(testNodeName); return tainted },
+		"node not tainted after ForceOff")
+}
+
+func TestSimulatedReplacedTransition(t *testing.T) {
+	tainter := &fakeTainter{tainted: make(map[string]bool)}
+	s := NewSimulatedServerSwitch(testNodeName, "sim-1", zap.NewNop(), BootDelay(20*time.Millisecond),
+		ShutdownDelay(time.Hour), TaintNode(tainter))
+
+	// A power on replaces the graceful power off in flight
+	_ = s.PowerOff()
+	_ = s.PowerOn()
+	time.Sleep(50 * time.Millisecond)
+	if !isOn(s) {
+		t.Fatal("replaced power off was applied")
+	}
+	if _, calls := tainter.isTainted(testNodeName); calls != 1 {
+		t.Fatalf("tainter called %d times, want 1", calls)
+	}
+
+	// Transitions firing at the same time as they are replaced must leave the state of the last one
+	for i := 0; i < 100; i++ {
+		_ = s.ForceOff()
+		_ = s.PowerOn()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !isOn(s) {
+		t.Fatal("simulated server off although the last transition was a power on")
+	}
+	if tainted, _ := tainter.isTainted(testNodeName); tainted {
+		t.Fatal("node tainted although the last transition was a power on")
+	}
+}
+
+// fakeNodeApi serves the nodes of a Kubernetes API server, enough to get and update them.
+type fakeNodeApi struct {
+	mu   sync.Mutex
+	node v1.Node
+}
+
+func (f *fakeNodeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/api/v1/nodes/"+testNodeName {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var node v1.Node
+		if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.node = node
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, f.node)
+}
+
+func (f *fakeNodeApi) taints() []v1.Taint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.node.Spec.Taints
+}
+
+func TestSimulatedPoweredOffTaint(t *testing.T) {
+	api := &fakeNodeApi{node: v1.Node{
+		TypeMeta:   metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: testNodeName},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("error creating clientset: %s", err)
+	}
+	s := NewSimulatedServerSwitch(testNodeName, "sim-1", zap.NewNop(), BootDelay(0),
+		TaintNode(kubeclient.NewKubeClient(clientset, zap.NewNop())))
+
+	_ = s.ForceOff()
+	eventually(t, func() bool {
+		taints := api.taints()
+		return len(taints) == 1 && taints[0].Key == kubeclient.PoweredOffTaintKey && taints[0].Effect == v1.TaintEffectNoExecute
+	}, "node not tainted with "+kubeclient.PoweredOffTaintKey+" once powered off")
+
+	_ = s.PowerOn()
+	eventually(t, func() bool { return len(api.taints()) == 0 }, "node still tainted once powered on")
+}